@@ -0,0 +1,495 @@
+// Package config loads the server's settings from, in increasing order of
+// precedence, built-in defaults, an optional YAML or TOML file, environment
+// variables and command-line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrInvalid is wrapped by every error caused by a bad setting
+var ErrInvalid = errors.New("invalid configuration")
+
+// Config ...the server's settings
+type Config struct {
+	// Listen is the host:port to serve on
+	Listen string
+	Store  Store
+	// Timeouts are those of the http.Server, plus how long shutdown waits
+	// for in-flight requests
+	Timeouts Timeouts
+	// IdempotencyWindow is how long POST responses are kept for replay
+	IdempotencyWindow time.Duration
+	// IdempotencyMaxEntries caps the POST responses kept for replay
+	IdempotencyMaxEntries int64
+	// MaxBodyBytes caps the size of a request body
+	MaxBodyBytes int64
+	// LogLevel is one of debug, info, warn or error
+	LogLevel string
+	Auth     Auth
+	Tenants  Tenants
+	TLS      TLS
+}
+
+// Store ...which TradeStore backend to open and where
+type Store struct {
+	// Backend is memory, file or sql
+	Backend string
+	// Dir holds the data of the file and sql backends
+	Dir string
+}
+
+// Timeouts ...http.Server timeouts and the shutdown drain period
+type Timeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+	Shutdown   time.Duration
+}
+
+// Auth ...API key settings
+type Auth struct {
+	// Enabled requires an API key on the trade endpoints
+	Enabled bool
+	// AdminKeys are API keys granted every permission
+	AdminKeys []string
+	// PolicyFile is a YAML or TOML file granting the roles of API keys their
+	// actions; without one every key may act on its own trades
+	PolicyFile string
+}
+
+// Tenants ...limits of each tenant's book of trades
+type Tenants struct {
+	// MaxTrades caps the trades of every book without its own quota; 0 is unlimited
+	MaxTrades int64
+	// Quotas caps the trades of single books by tenant, overriding MaxTrades
+	Quotas map[string]int64
+}
+
+// TLS ...certificate and key served over HTTPS; both empty serves plain HTTP
+type TLS struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Default returns the settings used when nothing overrides them
+func Default() Config {
+	return Config{
+		Listen: ":8080",
+		Timeouts: Timeouts{
+			ReadHeader: 5 * time.Second,
+			Read:       30 * time.Second,
+			// Generous enough for a large batch insert to be journaled
+			Write:    60 * time.Second,
+			Idle:     120 * time.Second,
+			Shutdown: 25 * time.Second,
+		},
+		IdempotencyWindow:     24 * time.Hour,
+		IdempotencyMaxEntries: 10000,
+		MaxBodyBytes:          10 << 20,
+		LogLevel:              "info",
+		Auth:                  Auth{Enabled: true},
+	}
+}
+
+// value ...a setting's field, read and written as a string
+type value interface {
+	Set(string) error
+	String() string
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) Set(s string) error { *v.p = s; return nil }
+func (v stringValue) String() string     { return *v.p }
+
+type durationValue struct{ p *time.Duration }
+
+func (v durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New("not a duration")
+	}
+	*v.p = d
+	return nil
+}
+func (v durationValue) String() string { return v.p.String() }
+
+type intValue struct{ p *int64 }
+
+func (v intValue) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.New("not an integer")
+	}
+	*v.p = n
+	return nil
+}
+func (v intValue) String() string { return strconv.FormatInt(*v.p, 10) }
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("not a boolean")
+	}
+	*v.p = b
+	return nil
+}
+func (v boolValue) String() string { return strconv.FormatBool(*v.p) }
+
+// listValue is a comma-separated list
+type listValue struct{ p *[]string }
+
+func (v listValue) Set(s string) error {
+	*v.p = []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			*v.p = append(*v.p, item)
+		}
+	}
+	return nil
+}
+func (v listValue) String() string { return strings.Join(*v.p, ",") }
+
+// quotaValue is a comma-separated list of name=count pairs
+type quotaValue struct{ p *map[string]int64 }
+
+func (v quotaValue) Set(s string) error {
+	quotas := map[string]int64{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+		name, count, ok := strings.Cut(item, "=")
+		n, err := strconv.ParseInt(strings.TrimSpace(count), 10, 64)
+		if !ok || err != nil || len(strings.TrimSpace(name)) == 0 {
+			return errors.New("not a list of name=count pairs")
+		}
+		quotas[strings.TrimSpace(name)] = n
+	}
+	*v.p = quotas
+	return nil
+}
+func (v quotaValue) String() string {
+	names := make([]string, 0, len(*v.p))
+	for name := range *v.p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + strconv.FormatInt((*v.p)[name], 10)
+	}
+	return strings.Join(names, ",")
+}
+
+// setting ...one configurable value
+type setting struct {
+	// key names the setting in the config file, with dots separating
+	// tables; the flag name is the key with dots and underscores as dashes
+	key   string
+	env   string
+	usage string
+	// secret settings are redacted when the config is printed
+	secret bool
+	// reloadable settings take effect when the config is reloaded; the
+	// rest only at startup
+	reloadable bool
+	field      func(c *Config) value
+}
+
+func (s setting) flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+var settings = []setting{
+	{key: "listen", env: "LISTEN_ADDR", usage: "host:port to listen on; PORT alone sets the port",
+		field: func(c *Config) value { return stringValue{&c.Listen} }},
+	{key: "store.backend", env: "STORE_BACKEND", usage: "trade store: memory, file or sql; defaults to file if a data dir is set",
+		field: func(c *Config) value { return stringValue{&c.Store.Backend} }},
+	{key: "store.dir", env: "DATA_DIR", usage: "directory holding the file or sql store",
+		field: func(c *Config) value { return stringValue{&c.Store.Dir} }},
+	{key: "timeouts.read_header", env: "READ_HEADER_TIMEOUT", usage: "time allowed to read request headers",
+		field: func(c *Config) value { return durationValue{&c.Timeouts.ReadHeader} }},
+	{key: "timeouts.read", env: "READ_TIMEOUT", usage: "time allowed to read a whole request",
+		field: func(c *Config) value { return durationValue{&c.Timeouts.Read} }},
+	{key: "timeouts.write", env: "WRITE_TIMEOUT", usage: "time allowed to write a response",
+		field: func(c *Config) value { return durationValue{&c.Timeouts.Write} }},
+	{key: "timeouts.idle", env: "IDLE_TIMEOUT", usage: "how long idle keep-alive connections are kept",
+		field: func(c *Config) value { return durationValue{&c.Timeouts.Idle} }},
+	{key: "timeouts.shutdown", env: "SHUTDOWN_TIMEOUT", usage: "how long shutdown waits for in-flight requests", reloadable: true,
+		field: func(c *Config) value { return durationValue{&c.Timeouts.Shutdown} }},
+	{key: "idempotency.window", env: "IDEMPOTENCY_WINDOW", usage: "how long POST responses are kept for Idempotency-Key replays", reloadable: true,
+		field: func(c *Config) value { return durationValue{&c.IdempotencyWindow} }},
+	{key: "idempotency.max_entries", env: "IDEMPOTENCY_MAX_ENTRIES", usage: "most POST responses kept for Idempotency-Key replays; the oldest are dropped first", reloadable: true,
+		field: func(c *Config) value { return intValue{&c.IdempotencyMaxEntries} }},
+	{key: "limits.max_body_bytes", env: "MAX_BODY_BYTES", usage: "largest request body accepted, in bytes", reloadable: true,
+		field: func(c *Config) value { return intValue{&c.MaxBodyBytes} }},
+	{key: "log.level", env: "LOG_LEVEL", usage: "debug, info, warn or error", reloadable: true,
+		field: func(c *Config) value { return stringValue{&c.LogLevel} }},
+	{key: "auth.enabled", env: "AUTH_ENABLED", usage: "require an API key on the trade endpoints",
+		field: func(c *Config) value { return boolValue{&c.Auth.Enabled} }},
+	{key: "auth.admin_keys", env: "ADMIN_API_KEYS", usage: "comma-separated API keys with every permission", secret: true, reloadable: true,
+		field: func(c *Config) value { return listValue{&c.Auth.AdminKeys} }},
+	{key: "auth.policy_file", env: "POLICY_FILE", usage: "YAML or TOML file granting the roles of API keys their actions", reloadable: true,
+		field: func(c *Config) value { return stringValue{&c.Auth.PolicyFile} }},
+	{key: "tenants.max_trades", env: "TENANT_MAX_TRADES", usage: "most trades a tenant's book may hold; 0 is unlimited", reloadable: true,
+		field: func(c *Config) value { return intValue{&c.Tenants.MaxTrades} }},
+	{key: "tenants.quotas", env: "TENANT_QUOTAS", usage: "comma-separated tenant=count overrides of tenants.max_trades", reloadable: true,
+		field: func(c *Config) value { return quotaValue{&c.Tenants.Quotas} }},
+	{key: "tls.cert_file", env: "TLS_CERT_FILE", usage: "PEM certificate to serve HTTPS with",
+		field: func(c *Config) value { return stringValue{&c.TLS.CertFile} }},
+	{key: "tls.key_file", env: "TLS_KEY_FILE", usage: "PEM private key of the certificate",
+		field: func(c *Config) value { return stringValue{&c.TLS.KeyFile} }},
+}
+
+func lookup(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// Load reads the config from the file named by the -config flag or the
+// CONFIG_FILE env var, if any, then env vars, then flags, and validates it.
+// args are the command-line arguments without the program name.
+func Load(args []string, getenv func(string) string) (Config, error) {
+	fs := flag.NewFlagSet("trades-server", flag.ContinueOnError)
+	path := fs.String("config", getenv("CONFIG_FILE"), "YAML (.yaml, .yml) or TOML (.toml) config file")
+	flagged := map[string]string{}
+	for _, s := range settings {
+		s := s
+		fs.Func(s.flag(), s.usage+" ($"+s.env+")", func(v string) error {
+			flagged[s.key] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, fmt.Errorf("%w: %s", ErrInvalid, err.Error())
+	}
+
+	c := Default()
+	set := func(key, v, source string) error {
+		s, ok := lookup(key)
+		if !ok {
+			return fmt.Errorf("%w: unknown setting %s in %s", ErrInvalid, key, source)
+		}
+		if err := s.field(&c).Set(v); err != nil {
+			return fmt.Errorf("%w: %s from %s: %s", ErrInvalid, key, source, err.Error())
+		}
+		return nil
+	}
+	if len(*path) > 0 {
+		values, err := readFile(*path)
+		if err != nil {
+			return Config{}, err
+		}
+		for key, v := range values {
+			if err := set(key, v, *path); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+	if port := getenv("PORT"); len(port) > 0 {
+		c.Listen = ":" + port
+	}
+	for _, s := range settings {
+		if v := getenv(s.env); len(v) > 0 {
+			if err := set(s.key, v, "$"+s.env); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flagged[s.key]; ok {
+			if err := set(s.key, v, "-"+s.flag()); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+
+	if len(c.Store.Backend) == 0 {
+		c.Store.Backend = "memory"
+		if len(c.Store.Dir) > 0 {
+			c.Store.Backend = "file"
+		}
+	}
+	if c.Store.Backend != "memory" && len(c.Store.Dir) == 0 {
+		c.Store.Dir = "."
+	}
+	return c, c.Validate()
+}
+
+// readFile returns the settings in a YAML or TOML file by key
+func readFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		m := map[string]interface{}{}
+		_, err = toml.Decode(string(b), &m)
+		doc = m
+	default:
+		return nil, fmt.Errorf("%w: config file %s is not .yaml, .yml or .toml", ErrInvalid, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalid, path, err.Error())
+	}
+	values := map[string]string{}
+	return values, flatten("", doc, values)
+}
+
+// flatten stores the scalars and lists in doc by their dotted key
+func flatten(prefix string, doc interface{}, values map[string]string) error {
+	switch n := doc.(type) {
+	case nil:
+		return nil
+	case map[interface{}]interface{}:
+		for k, v := range n {
+			if err := flatten(prefix+fmt.Sprint(k)+".", v, values); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		for k, v := range n {
+			if err := flatten(prefix+k+".", v, values); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		items := make([]string, len(n))
+		for i, item := range n {
+			items[i] = fmt.Sprint(item)
+		}
+		values[strings.TrimSuffix(prefix, ".")] = strings.Join(items, ",")
+		return nil
+	}
+	if len(prefix) == 0 {
+		return fmt.Errorf("%w: config file is not a table of settings", ErrInvalid)
+	}
+	values[strings.TrimSuffix(prefix, ".")] = fmt.Sprint(doc)
+	return nil
+}
+
+// Validate reports every setting of c that the server cannot start with
+func (c Config) Validate() error {
+	problems := []string{}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, "listen must be host:port")
+	}
+	switch c.Store.Backend {
+	case "memory", "file", "sql":
+	default:
+		problems = append(problems, "store.backend must be memory, file or sql")
+	}
+	for _, s := range settings {
+		if d, ok := s.field(&c).(durationValue); ok && *d.p < 0 {
+			problems = append(problems, s.key+" must not be negative")
+		}
+	}
+	if c.IdempotencyMaxEntries <= 0 {
+		problems = append(problems, "idempotency.max_entries must be positive")
+	}
+	if c.MaxBodyBytes <= 0 {
+		problems = append(problems, "limits.max_body_bytes must be positive")
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, "log.level must be debug, info, warn or error")
+	}
+	if c.Tenants.MaxTrades < 0 {
+		problems = append(problems, "tenants.max_trades must not be negative")
+	}
+	for name, n := range c.Tenants.Quotas {
+		if n < 0 {
+			problems = append(problems, "tenants.quotas of "+name+" must not be negative")
+		}
+	}
+	if c.Auth.Enabled && len(c.Auth.AdminKeys) == 0 {
+		problems = append(problems, "auth.admin_keys must be set while auth.enabled is true")
+	}
+	if (len(c.TLS.CertFile) == 0) != (len(c.TLS.KeyFile) == 0) {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+	for _, f := range []string{c.TLS.CertFile, c.TLS.KeyFile} {
+		if _, err := os.Stat(f); len(f) > 0 && err != nil {
+			problems = append(problems, "cannot read "+f)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// String lists every setting of c, one key=value per line, with secrets redacted
+func (c Config) String() string {
+	var b strings.Builder
+	for _, s := range settings {
+		v := s.field(&c).String()
+		if s.secret && len(v) > 0 {
+			v = "[redacted]"
+		}
+		b.WriteString(s.key + "=" + v + "\n")
+	}
+	return b.String()
+}
+
+// LogValue logs c as a group of its settings, with secrets redacted
+func (c Config) LogValue() slog.Value {
+	attrs := make([]slog.Attr, 0, len(settings))
+	for _, s := range settings {
+		v := s.field(&c).String()
+		if s.secret && len(v) > 0 {
+			v = "[redacted]"
+		}
+		attrs = append(attrs, slog.String(s.key, v))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Reload returns current with the reloadable settings of next applied, and
+// the keys of the settings that differ but only take effect on restart
+func Reload(current, next Config) (Config, []string) {
+	ret := current
+	pending := []string{}
+	for _, s := range settings {
+		v := s.field(&next).String()
+		if v == s.field(&current).String() {
+			continue
+		}
+		if !s.reloadable {
+			pending = append(pending, s.key)
+			continue
+		}
+		// The value was produced by String, so it parses
+		s.field(&ret).Set(v)
+	}
+	return ret, pending
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// env returns a getenv of vars. Authentication is disabled unless vars set
+// AUTH_ENABLED, so that tests of other settings need no admin key.
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		if v, ok := vars[name]; ok || name != "AUTH_ENABLED" {
+			return v
+		}
+		return "false"
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := Load(nil, env(nil))
+	assert.Nil(t, err)
+	want := Default()
+	want.Store.Backend = "memory"
+	want.Auth.Enabled = false
+	assert.Equal(t, want, c)
+
+	c, err = Load(nil, env(map[string]string{"DATA_DIR": "/data", "PORT": "9090"}))
+	assert.Nil(t, err)
+	assert.Equal(t, Store{Backend: "file", Dir: "/data"}, c.Store, "A data dir defaults to the file store")
+	assert.Equal(t, ":9090", c.Listen)
+
+	c, err = Load(nil, env(map[string]string{"STORE_BACKEND": "sql"}))
+	assert.Nil(t, err)
+	assert.Equal(t, Store{Backend: "sql", Dir: "."}, c.Store)
+}
+
+func TestLoadRequiresAdminKeys(t *testing.T) {
+	_, err := Load(nil, func(string) string { return "" })
+	assert.True(t, errors.Is(err, ErrInvalid))
+	assert.Contains(t, err.Error(), "auth.admin_keys", "Authentication is on by default")
+
+	c, err := Load(nil, env(map[string]string{"AUTH_ENABLED": "true", "ADMIN_API_KEYS": "k"}))
+	assert.Nil(t, err)
+	assert.Equal(t, Auth{Enabled: true, AdminKeys: []string{"k"}}, c.Auth)
+
+	_, err = Load(nil, env(map[string]string{"AUTH_ENABLED": "maybe"}))
+	assert.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	yamlPath := writeConfig(t, "server.yaml", `
+listen: ":7000"
+timeouts:
+  read: 10s
+  write: 20s
+limits:
+  max_body_bytes: 2048
+auth:
+  admin_keys: [one, two]
+  policy_file: policy.yaml
+tenants:
+  max_trades: 100
+  quotas: ["acme=5", "globex = 0"]
+`)
+	vars := map[string]string{"CONFIG_FILE": yamlPath, "WRITE_TIMEOUT": "30s", "LOG_LEVEL": "warn"}
+	c, err := Load([]string{"-log-level", "debug"}, env(vars))
+	assert.Nil(t, err)
+	assert.Equal(t, ":7000", c.Listen)
+	assert.Equal(t, 10*time.Second, c.Timeouts.Read, "The file overrides defaults")
+	assert.Equal(t, 30*time.Second, c.Timeouts.Write, "The environment overrides the file")
+	assert.Equal(t, "debug", c.LogLevel, "Flags override the environment")
+	assert.Equal(t, int64(2048), c.MaxBodyBytes)
+	assert.Equal(t, []string{"one", "two"}, c.Auth.AdminKeys)
+	assert.Equal(t, "policy.yaml", c.Auth.PolicyFile)
+	assert.Equal(t, Tenants{MaxTrades: 100, Quotas: map[string]int64{"acme": 5, "globex": 0}}, c.Tenants)
+	assert.Equal(t, 5*time.Second, c.Timeouts.ReadHeader)
+
+	tomlPath := writeConfig(t, "server.toml", `
+listen = "127.0.0.1:7001"
+
+[store]
+backend = "sql"
+dir = "/var/trades"
+
+[idempotency]
+window = "1h"
+max_entries = 500
+`)
+	c, err = Load([]string{"-config", tomlPath}, env(vars))
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:7001", c.Listen)
+	assert.Equal(t, Store{Backend: "sql", Dir: "/var/trades"}, c.Store)
+	assert.Equal(t, time.Hour, c.IdempotencyWindow)
+	assert.Equal(t, int64(500), c.IdempotencyMaxEntries)
+}
+
+func TestLoadRejectsBadSettings(t *testing.T) {
+	for name, load := range map[string]func() (Config, error){
+		"unknown flag":      func() (Config, error) { return Load([]string{"-nope"}, env(nil)) },
+		"bad duration":      func() (Config, error) { return Load(nil, env(map[string]string{"READ_TIMEOUT": "soon"})) },
+		"negative duration": func() (Config, error) { return Load([]string{"-timeouts-idle", "-1s"}, env(nil)) },
+		"bad backend":       func() (Config, error) { return Load(nil, env(map[string]string{"STORE_BACKEND": "mongo"})) },
+		"bad listen":        func() (Config, error) { return Load([]string{"-listen", "8080"}, env(nil)) },
+		"bad log level":     func() (Config, error) { return Load(nil, env(map[string]string{"LOG_LEVEL": "loud"})) },
+		"zero body limit":   func() (Config, error) { return Load(nil, env(map[string]string{"MAX_BODY_BYTES": "0"})) },
+		"bad quotas":        func() (Config, error) { return Load(nil, env(map[string]string{"TENANT_QUOTAS": "acme"})) },
+		"negative quota":    func() (Config, error) { return Load(nil, env(map[string]string{"TENANT_QUOTAS": "acme=-1"})) },
+		"half of TLS":       func() (Config, error) { return Load(nil, env(map[string]string{"TLS_CERT_FILE": "cert.pem"})) },
+		"missing TLS files": func() (Config, error) {
+			return Load([]string{"-tls-cert-file", "/no/cert", "-tls-key-file", "/no/key"}, env(nil))
+		},
+		"unknown file key": func() (Config, error) {
+			return Load([]string{"-config", writeConfig(t, "c.yaml", "colour: blue")}, env(nil))
+		},
+		"bad file value": func() (Config, error) {
+			return Load([]string{"-config", writeConfig(t, "c.yml", "limits: {max_body_bytes: lots}")}, env(nil))
+		},
+		"unknown file type": func() (Config, error) { return Load([]string{"-config", writeConfig(t, "c.json", "{}")}, env(nil)) },
+		"malformed TOML": func() (Config, error) {
+			return Load([]string{"-config", writeConfig(t, "c.toml", "listen = ")}, env(nil))
+		},
+		"file is not a table": func() (Config, error) { return Load([]string{"-config", writeConfig(t, "c.yaml", "- a")}, env(nil)) },
+	} {
+		_, err := load()
+		assert.True(t, errors.Is(err, ErrInvalid), name)
+	}
+
+	_, err := Load([]string{"-config", "/no/such/file.yaml"}, env(nil))
+	assert.NotNil(t, err)
+
+	_, err = Load(nil, env(map[string]string{"LOG_LEVEL": "loud", "MAX_BODY_BYTES": "-1"}))
+	assert.Contains(t, err.Error(), "log.level", "Every problem is reported")
+	assert.Contains(t, err.Error(), "limits.max_body_bytes")
+}
+
+func TestStringRedactsSecrets(t *testing.T) {
+	c, err := Load(nil, env(map[string]string{"ADMIN_API_KEYS": "s3cret-1, s3cret-2"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"s3cret-1", "s3cret-2"}, c.Auth.AdminKeys)
+	s := c.String()
+	assert.NotContains(t, s, "s3cret")
+	assert.Contains(t, s, "auth.admin_keys=[redacted]\n")
+	assert.Contains(t, s, "listen=:8080\n")
+	assert.Contains(t, s, "timeouts.idle=2m0s\n")
+}
+
+func TestReload(t *testing.T) {
+	current, _ := Load(nil, env(nil))
+	next, _ := Load(nil, env(map[string]string{
+		"LOG_LEVEL":        "debug",
+		"ADMIN_API_KEYS":   "new-key",
+		"MAX_BODY_BYTES":   "1024",
+		"LISTEN_ADDR":      ":9999",
+		"READ_TIMEOUT":     "1s",
+		"SHUTDOWN_TIMEOUT": "5s",
+		"TENANT_QUOTAS":    "acme=5",
+		"POLICY_FILE":      "policy.toml",
+	}))
+	c, pending := Reload(current, next)
+	assert.Equal(t, "debug", c.LogLevel)
+	assert.Equal(t, []string{"new-key"}, c.Auth.AdminKeys)
+	assert.Equal(t, int64(1024), c.MaxBodyBytes)
+	assert.Equal(t, 5*time.Second, c.Timeouts.Shutdown)
+	assert.Equal(t, map[string]int64{"acme": 5}, c.Tenants.Quotas)
+	assert.Equal(t, "policy.toml", c.Auth.PolicyFile)
+	assert.Equal(t, ":8080", c.Listen, "The listener is only configured at startup")
+	assert.Equal(t, 30*time.Second, c.Timeouts.Read)
+	assert.Equal(t, "listen, timeouts.read", strings.Join(pending, ", "))
+	assert.Equal(t, "info", current.LogLevel, "The current config is not modified")
+}
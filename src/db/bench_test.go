@@ -0,0 +1,129 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+// batchJSON returns a batch of n trades with unique tickers and client IDs
+func batchJSON(prefix string, n int) []byte {
+	var b bytes.Buffer
+	b.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"client_trade_id":"%s-%d","date":20200101,"quantity":"1","price":"1.00","ticker":"%s%d"}`, prefix, i, prefix, i)
+	}
+	b.WriteString("]")
+	return b.Bytes()
+}
+
+// BenchmarkAtomicInsertBatch inserts a batch into a store already holding
+// as many trades. With indexed uniqueness checks the cost per trade stays
+// flat as the batch and store grow; BenchmarkCheckUnique compares them with
+// the previous scan-based checks, which were quadratic in both.
+func BenchmarkAtomicInsertBatch(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		seed := batchJSON("S", n)
+		batch := batchJSON("B", n)
+		b.Run(fmt.Sprintf("size=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s := NewMemoryStore()
+				if _, err := s.AtomicInsertTradesFromJSONArray(seed, Mutation{}); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if _, err := s.AtomicInsertTradesFromJSONArray(batch, Mutation{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// scanCheckUnique is checkUnique as it was before the indexes: every trade
+// is compared with every stored trade and every other trade of the batch
+func scanCheckUnique(s *MemoryStore, trades []model.Trade) error {
+	for _, t := range trades {
+		for _, v := range s.trades {
+			if t.Ticker == v.Ticker || t.ClientTradeID == v.ClientTradeID {
+				return ErrDuplicateTrade
+			}
+		}
+	}
+	for i, t := range trades {
+		for j, q := range trades {
+			if i != j && (t.ClientTradeID == q.ClientTradeID || t.Ticker == q.Ticker) {
+				return ErrDuplicateTrade
+			}
+		}
+	}
+
+	return nil
+}
+
+// BenchmarkCheckUnique isolates the uniqueness check from JSON parsing, and
+// runs the indexed check against the scan it replaced
+func BenchmarkCheckUnique(b *testing.B) {
+	checks := []struct {
+		name  string
+		check func(*MemoryStore, []model.Trade) error
+	}{
+		{"index", (*MemoryStore).checkUnique},
+		{"scan", scanCheckUnique},
+	}
+	for _, n := range []int{100, 1000, 5000} {
+		s := NewMemoryStore()
+		if _, err := s.AtomicInsertTradesFromJSONArray(batchJSON("S", n), Mutation{}); err != nil {
+			b.Fatal(err)
+		}
+		trades, err := s.GetTradesFromJSONArraySafe(batchJSON("B", n))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, c := range checks {
+			b.Run(fmt.Sprintf("%s/size=%d", c.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := c.check(s, trades); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkQueryByTicker looks up one ticker in a large store, through the
+// index and by scanning every trade as before the index
+func BenchmarkQueryByTicker(b *testing.B) {
+	s := NewMemoryStore()
+	if _, err := s.AtomicInsertTradesFromJSONArray(batchJSON("S", 10000), Mutation{}); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			page, err := s.QueryTrades(TradeQuery{Ticker: "S5000"})
+			if err != nil || len(page.Trades) != 1 {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			found := 0
+			for _, t := range s.trades {
+				if t.Ticker == "S5000" {
+					found++
+				}
+			}
+			if found != 1 {
+				b.Fatal(found)
+			}
+		}
+	})
+}
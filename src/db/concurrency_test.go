@@ -0,0 +1,95 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentInsertSameTickerOnlyOneWins(t *testing.T) {
+	s := NewMemoryStore()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successes := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			JSON := []byte(fmt.Sprintf(`[{"client_trade_id":"C-%d","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`, i))
+			if _, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{}); err == nil {
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, successes, "Exactly one batch with a given ticker should be accepted")
+	all, _ := s.GetAllTrades()
+	assert.Equal(t, 1, len(all))
+}
+
+func TestConcurrentBatchesAreAllOrNothing(t *testing.T) {
+	s := NewMemoryStore()
+	var wg sync.WaitGroup
+
+	// Every batch shares ticker SHRD with every other batch, so at most one
+	// batch may land and no batch may be partially inserted.
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			JSON := []byte(fmt.Sprintf(`[{"client_trade_id":"A-%d","date":20010101,"quantity":"10","price":"5.67","ticker":"U%d"},{"client_trade_id":"B-%d","date":20010101,"quantity":"10","price":"5.67","ticker":"SHRD"}]`, i, i, i))
+			s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+		}(i)
+	}
+	wg.Wait()
+
+	all, _ := s.GetAllTrades()
+	assert.Equal(t, 2, len(all), "Only the winning batch should be stored, in full")
+}
+
+func TestConcurrentUpdateAndDelete(t *testing.T) {
+	s := NewMemoryStore()
+	JSON := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
+	key, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+	assert.Nil(t, err)
+	id := key[0].TradeID
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	deleted, updated := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := s.DeleteTradeByID(id, Mutation{}); err == nil {
+				mu.Lock()
+				deleted++
+				mu.Unlock()
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			body := []byte(fmt.Sprintf(`{"client_trade_id":"U-%d","date":20010101,"quantity":"10","price":"5.67","ticker":"U%d"}`, i, i))
+			if _, err := s.UpdateExistingTrade(body, id, Mutation{}); err == nil {
+				mu.Lock()
+				updated++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Updates keep the trade's ID, so exactly one delete wins and no update
+	// can resurrect the trade after it
+	assert.Equal(t, 1, deleted, "The trade can be deleted exactly once")
+	assert.True(t, updated <= 20)
+	_, err = s.GetTradeByID(id)
+	assert.Equal(t, ErrTradeNotFound, err)
+	assertIndexesConsistent(t, s)
+}
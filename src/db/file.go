@@ -0,0 +1,285 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy controls when the write-ahead log is flushed to stable storage
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs the log before every mutation is acknowledged
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval syncs the log in the background every FileOptions.FsyncInterval
+	FsyncInterval
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.db"
+)
+
+// FileOptions ...configuration for a FileStore
+type FileOptions struct {
+	// Dir holds the write-ahead log and snapshot; it is created if missing
+	Dir string
+	// Fsync is the WAL flush policy; defaults to FsyncAlways
+	Fsync FsyncPolicy
+	// FsyncInterval is used by FsyncInterval; defaults to one second
+	FsyncInterval time.Duration
+	// SnapshotEvery compacts the log into a snapshot after this many records; 0 uses 1000
+	SnapshotEvery int
+}
+
+// walFile ...the open write-ahead log; an *os.File
+type walFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// FileStore is a MemoryStore made durable by a checksummed write-ahead log
+// that is periodically compacted into a snapshot and replayed on open
+type FileStore struct {
+	*MemoryStore
+
+	opts FileOptions
+
+	// walMu guards wal and dirty against the background fsync goroutine
+	walMu   sync.Mutex
+	wal     walFile
+	dirty   bool
+	records int
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// OpenFileStore loads the snapshot and replays the log in opts.Dir.
+// A torn final log record is truncated away rather than treated as fatal.
+func OpenFileStore(opts FileOptions) (*FileStore, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("file store directory not set")
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if opts.SnapshotEvery <= 0 {
+		opts.SnapshotEvery = 1000
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{MemoryStore: NewMemoryStore(), opts: opts, done: make(chan struct{})}
+
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := fs.replayWAL(); err != nil {
+		return nil, err
+	}
+	fs.MemoryStore.journal = fs
+
+	if opts.Fsync == FsyncInterval {
+		fs.wg.Add(1)
+		go fs.syncLoop()
+	}
+
+	return fs, nil
+}
+
+func (fs *FileStore) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(fs.opts.Dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Snapshots are renamed into place only once complete, so any damage is fatal
+	_, err = readRecords(f, func(ops []op) error {
+		fs.MemoryStore.apply(ops)
+		return nil
+	})
+
+	return err
+}
+
+func (fs *FileStore) replayWAL() error {
+	f, err := os.OpenFile(filepath.Join(fs.opts.Dir, walFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	offset, err := readRecords(f, func(ops []op) error {
+		fs.MemoryStore.apply(ops)
+		fs.records++
+		return nil
+	})
+	if err == errTornRecord {
+		slog.Warn("truncating torn write-ahead log record", "dir", fs.opts.Dir, "offset", offset)
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fs.wal = f
+
+	return nil
+}
+
+// record appends ops to the log as a single record so a batch is replayed all-or-nothing
+func (fs *FileStore) record(ops []op) error {
+	rec, err := encodeRecord(ops)
+	if err != nil {
+		return err
+	}
+	fs.walMu.Lock()
+	defer fs.walMu.Unlock()
+	if fs.wal == nil {
+		return errors.New("file store is closed")
+	}
+	offset, err := fs.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = fs.wal.Write(rec)
+	if err == nil && fs.opts.Fsync == FsyncAlways {
+		err = fs.wal.Sync()
+	}
+	if err != nil {
+		// The caller is told the ops failed, so they must not be replayed,
+		// nor may a torn record end up in the middle of the log
+		fs.rollback(offset)
+		return err
+	}
+	fs.records++
+	if fs.opts.Fsync != FsyncAlways {
+		fs.dirty = true
+	}
+
+	return nil
+}
+
+// rollback truncates the log back to offset after a failed append; callers
+// must hold walMu. If that fails too the log is closed, since appending after
+// a partial record would make every later record unreadable.
+func (fs *FileStore) rollback(offset int64) {
+	err := fs.wal.Truncate(offset)
+	if err == nil {
+		_, err = fs.wal.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		err = fs.wal.Sync()
+	}
+	if err != nil {
+		slog.Error("could not roll back write-ahead log; closing file store", "dir", fs.opts.Dir, "error", err.Error())
+		fs.wal.Close()
+		fs.wal = nil
+	}
+}
+
+// committed compacts the log once enough records have accumulated
+func (fs *FileStore) committed(s *MemoryStore) {
+	if fs.records >= fs.opts.SnapshotEvery {
+		// A failed snapshot leaves the log intact; it is retried on the next commit
+		if err := fs.snapshot(s); err != nil {
+			slog.Error("could not snapshot file store", "dir", fs.opts.Dir, "error", err.Error())
+		}
+	}
+}
+
+// snapshot writes the full state and then empties the log; callers must hold s.mu.
+// Ops are idempotent, so a crash between the two steps only causes a harmless replay.
+func (fs *FileStore) snapshot(s *MemoryStore) error {
+	rec, err := encodeRecord(s.snapshotOps())
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(fs.opts.Dir, snapshotFileName), rec); err != nil {
+		return err
+	}
+	fs.walMu.Lock()
+	defer fs.walMu.Unlock()
+	if fs.wal == nil {
+		return errors.New("file store is closed")
+	}
+	if err := fs.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fs.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fs.records = 0
+	fs.dirty = false
+
+	return nil
+}
+
+// Compact forces a snapshot of the current state and truncates the log
+func (fs *FileStore) Compact() error {
+	fs.MemoryStore.mu.Lock()
+	defer fs.MemoryStore.mu.Unlock()
+
+	return fs.snapshot(fs.MemoryStore)
+}
+
+func (fs *FileStore) syncLoop() {
+	defer fs.wg.Done()
+	ticker := time.NewTicker(fs.opts.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := fs.Sync(); err != nil {
+				slog.Error("could not sync write-ahead log", "dir", fs.opts.Dir, "error", err.Error())
+			}
+		case <-fs.done:
+			return
+		}
+	}
+}
+
+// Sync flushes any unsynced log records to stable storage
+func (fs *FileStore) Sync() error {
+	fs.walMu.Lock()
+	defer fs.walMu.Unlock()
+	if fs.wal == nil || !fs.dirty {
+		return nil
+	}
+	fs.dirty = false
+
+	return fs.wal.Sync()
+}
+
+// Close flushes and closes the log; the store rejects mutations afterwards
+func (fs *FileStore) Close() error {
+	fs.closeOnce.Do(func() { close(fs.done) })
+	fs.wg.Wait()
+	fs.walMu.Lock()
+	defer fs.walMu.Unlock()
+	if fs.wal == nil {
+		return nil
+	}
+	err := fs.wal.Sync()
+	if cerr := fs.wal.Close(); err == nil {
+		err = cerr
+	}
+	fs.wal = nil
+
+	return err
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "trades-filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileStoreReplaysAfterReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	JSONs := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"},{"client_trade_id":"23456","date":20010102,"quantity":"20","price":"87.1","ticker":"AAPL"}]`)
+	keys, err := fs.AtomicInsertTradesFromJSONArray(JSONs, Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.DeleteTradeByID(keys[0].TradeID, Mutation{}))
+	updated, err := fs.UpdateExistingTrade([]byte(`{"client_trade_id":"34567","date":20010102,"quantity":"7","price":"5.4","ticker":"AMZN"}`), keys[1].TradeID, Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Close())
+
+	fs, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	defer fs.Close()
+	all, _ := fs.GetAllTrades()
+	assert.Equal(t, 1, len(all))
+	got, err := fs.GetTradeByID(updated.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, updated.Trade, got.Trade)
+	history, err := fs.TradeHistory(updated.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(history), "History should be replayed with the trades")
+
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"99999","date":20010101,"quantity":"1","price":"1","ticker":"AMZN"}]`), Mutation{})
+	assert.NotNil(t, err, "Uniqueness should hold against replayed trades")
+}
+
+func TestFileStoreSnapshotCompactsLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir, SnapshotEvery: 2, Fsync: FsyncNever})
+	assert.Nil(t, err)
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"A"}]`), Mutation{})
+	assert.Nil(t, err)
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"2","date":20010101,"quantity":"1","price":"1","ticker":"B"}]`), Mutation{})
+	assert.Nil(t, err)
+
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size(), "The log should be empty right after a snapshot")
+
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"3","date":20010101,"quantity":"1","price":"1","ticker":"C"}]`), Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Close())
+
+	fs, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	defer fs.Close()
+	all, _ := fs.GetAllTrades()
+	assert.Equal(t, 3, len(all), "State should be snapshot plus log")
+}
+
+func TestFileStoreTruncatesTornFinalRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"A"}]`), Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Close())
+
+	walPath := filepath.Join(dir, walFileName)
+	good, _ := ioutil.ReadFile(walPath)
+	rec, _ := encodeRecord([]op{{Kind: opPut, ID: "x", Trade: fsTrade("B")}})
+	assert.Nil(t, ioutil.WriteFile(walPath, append(good, rec[:len(rec)-3]...), 0644))
+
+	fs, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err, "A torn final record should not prevent opening")
+	all, _ := fs.GetAllTrades()
+	assert.Equal(t, 1, len(all))
+	assert.Nil(t, fs.Close())
+
+	after, _ := ioutil.ReadFile(walPath)
+	assert.Equal(t, good, after, "The torn record should have been truncated")
+}
+
+// failingWAL writes only half of its first record, or fails the first sync
+// of a whole one
+type failingWAL struct {
+	walFile
+	torn   bool
+	failed bool
+}
+
+func (w *failingWAL) Write(b []byte) (int, error) {
+	if w.torn && !w.failed {
+		w.failed = true
+		n, _ := w.walFile.Write(b[:len(b)/2])
+		return n, errors.New("disk full")
+	}
+	return w.walFile.Write(b)
+}
+
+func (w *failingWAL) Sync() error {
+	if !w.torn && !w.failed {
+		w.failed = true
+		return errors.New("fsync failed")
+	}
+	return w.walFile.Sync()
+}
+
+func TestFileStoreRollsBackFailedRecords(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir, Fsync: FsyncAlways})
+	assert.Nil(t, err)
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"A"}]`), Mutation{})
+	assert.Nil(t, err)
+	wal := fs.wal
+	for _, torn := range []bool{true, false} {
+		fs.wal = &failingWAL{walFile: wal, torn: torn}
+		_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"2","date":20010101,"quantity":"1","price":"1","ticker":"B"}]`), Mutation{})
+		assert.NotNil(t, err)
+	}
+	fs.wal = wal
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"3","date":20010101,"quantity":"1","price":"1","ticker":"C"}]`), Mutation{})
+	assert.Nil(t, err, "Appends after a rollback should succeed")
+	assert.Nil(t, fs.Close())
+
+	fs, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err, "A failed record should not be left mid-log")
+	defer fs.Close()
+	all, _ := fs.GetAllTrades()
+	tickers := []string{}
+	for _, tr := range all {
+		tickers = append(tickers, tr.Trade.Ticker)
+	}
+	assert.ElementsMatch(t, []string{"A", "C"}, tickers, "Failed records should not be replayed")
+}
+
+func TestFileStoreRejectsMidLogCorruption(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"A"}]`), Mutation{})
+	assert.Nil(t, err)
+	_, err = fs.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"2","date":20010101,"quantity":"1","price":"1","ticker":"B"}]`), Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Close())
+
+	walPath := filepath.Join(dir, walFileName)
+	b, _ := ioutil.ReadFile(walPath)
+	b[walHeaderSize+2] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(walPath, b, 0644))
+
+	_, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.NotNil(t, err, "Corruption followed by valid records must not be silently dropped")
+}
+
+func TestFileStorePersistsLegacyIDAliases(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	seedLegacyTrade(t, fs, fsTrade("PRTH"))
+	_, err = fs.MigrateLegacyIDs()
+	assert.Nil(t, err)
+	migrated, _ := fs.GetTradeByID(legacyID)
+	assert.Nil(t, fs.Compact())
+	assert.Nil(t, fs.Close())
+
+	fs, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	defer fs.Close()
+	got, err := fs.GetTradeByID(legacyID)
+	assert.Nil(t, err, "Aliases should survive a snapshot and reopen")
+	assert.Equal(t, migrated.ID, got.ID)
+}
+
+func TestFileStorePersistsOwnersAndKeys(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	issued, err := fs.CreateAPIKey("alice", false, "trader")
+	assert.Nil(t, err)
+	submitted, _, err := fs.InsertEachTrade([]model.Trade{fsTrade("PRTH")}, Mutation{Owner: "alice"})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Compact())
+	_, err = fs.CreateAPIKey("bob", false)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Close())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, snapshotFileName))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), issued.Key, "Only key hashes are written")
+
+	fs, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	defer fs.Close()
+	got, err := fs.Authenticate(issued.Key)
+	assert.Nil(t, err, "Keys should survive a snapshot and reopen")
+	assert.Equal(t, "alice", got.ClientID)
+	assert.Equal(t, []string{"trader"}, got.Roles, "Roles should survive a snapshot and reopen")
+	keys, _ := fs.ListAPIKeys()
+	assert.Equal(t, 2, len(keys), "Keys created after the snapshot are replayed from the log")
+	trade, err := fs.GetTradeByID(submitted[0].TradeID)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", trade.Owner)
+}
+
+func TestFileStorePersistsBooks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	_, _, err = fs.Book("acme").InsertEachTrade([]model.Trade{fsTrade("PRTH")}, Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Compact())
+	_, _, err = fs.Book("acme").InsertEachTrade([]model.Trade{fsTrade("AMZN")}, Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Close())
+
+	fs, err = OpenFileStore(FileOptions{Dir: dir})
+	assert.Nil(t, err)
+	defer fs.Close()
+	all, _ := fs.Book("acme").GetAllTrades()
+	assert.ElementsMatch(t, []string{"PRTH", "AMZN"}, tickers(all), "Books should survive a snapshot and reopen")
+	all, _ = fs.GetAllTrades()
+	assert.Equal(t, 0, len(all))
+	_, errs, err := fs.Book("acme").InsertEachTrade([]model.Trade{fsTrade("PRTH")}, Mutation{})
+	assert.Nil(t, err)
+	assert.Equal(t, []error{ErrDuplicateTrade}, errs)
+	_, errs, _ = fs.InsertEachTrade([]model.Trade{fsTrade("PRTH")}, Mutation{})
+	assert.Equal(t, []error{nil}, errs)
+}
+
+func fsTrade(ticker string) model.Trade {
+	return model.Trade{ClientTradeID: ticker, Date: 20010101, Quantity: model.MustParseDecimal("1"), Price: model.MustParseDecimal("1"), Ticker: ticker}
+}
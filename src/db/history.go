@@ -0,0 +1,98 @@
+package db
+
+import (
+	"time"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+// Mutation ...who is changing trades and why; recorded with every version
+type Mutation struct {
+	Actor  string
+	Reason string
+	// IfVersion, when set, is the version the trade must be at for the
+	// mutation to apply; otherwise it fails with ErrVersionMismatch
+	IfVersion *int
+	// Owner is the client the trades the mutation creates belong to
+	Owner string
+	// MaxTrades, when positive, is the most trades the book may hold once
+	// the mutation has created its trades; otherwise it fails with ErrQuotaExceeded
+	MaxTrades int
+}
+
+// ownerOp returns the op recording s's book and m's Owner for new trade id;
+// callers must hold mu
+func (s *MemoryStore) ownerOp(id string, m Mutation) op {
+	return op{Kind: opOwner, ID: id, Owner: m.Owner, Tenant: s.tenant}
+}
+
+// allows reports whether m may be applied to a trade at version current
+func (m Mutation) allows(current int) bool {
+	return m.IfVersion == nil || *m.IfVersion == current
+}
+
+// fits reports whether a book holding count trades may gain n more under m's quota
+func (m Mutation) fits(count, n int) bool {
+	return m.MaxTrades <= 0 || count+n <= m.MaxTrades
+}
+
+// versionOp returns the op recording the next version of trade id; callers must hold mu
+func (s *MemoryStore) versionOp(id string, action model.Action, before, after *model.Trade, m Mutation) op {
+	v := &model.TradeVersion{
+		TradeID: id,
+		Version: len(s.history[id]) + 1,
+		Action:  action,
+		Actor:   m.Actor,
+		Reason:  m.Reason,
+		At:      s.now().UTC(),
+		Before:  before,
+		After:   after,
+	}
+
+	return op{Kind: opVersion, ID: id, Version: v}
+}
+
+// TradeHistory ...used by HandleFunc GET /v1/trades/{trade_id}/history
+func (s *MemoryStore) TradeHistory(id string) ([]model.TradeVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id = s.resolve(id)
+	versions := s.history[id]
+	if !s.known(id) {
+		return []model.TradeVersion{}, ErrTradeNotFound
+	}
+
+	return append([]model.TradeVersion{}, versions...), nil
+}
+
+// TradeAsOf ...used by HandleFunc GET /v1/trades/{trade_id}?as_of=
+func (s *MemoryStore) TradeAsOf(id string, at time.Time) (model.InternalTrade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id = s.resolve(id)
+	if !s.known(id) {
+		return model.InternalTrade{}, ErrTradeNotFound
+	}
+	versions := s.history[id]
+	if current, ok := s.trades[id]; ok && len(versions) == 0 {
+		// Booked before history was kept, so it is assumed to have always looked like this
+		return model.InternalTrade{ID: id, Trade: current}, nil
+	}
+
+	return tradeAsOf(id, versions, at)
+}
+
+// tradeAsOf returns the state of trade id after the last of versions committed at or before at
+func tradeAsOf(id string, versions []model.TradeVersion, at time.Time) (model.InternalTrade, error) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].At.After(at) {
+			continue
+		}
+		if versions[i].After == nil {
+			return model.InternalTrade{}, ErrTradeNotFound
+		}
+		return model.InternalTrade{ID: id, Trade: *versions[i].After, Version: versions[i].Version}, nil
+	}
+
+	return model.InternalTrade{}, ErrTradeNotFound
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Trade IDs are ULIDs: a 48-bit millisecond timestamp followed by 80 random
+// bits, written as 26 Crockford base32 characters. They sort by creation
+// time both as strings and bytes, and are assigned once when a trade is
+// inserted; updates never change them.
+const (
+	crockford   = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	tradeIDLen  = 26
+	legacyIDLen = 32
+)
+
+// idGenerator ...monotonic ULID source; IDs minted in the same millisecond
+// increment the random part so they stay unique and ordered
+type idGenerator struct {
+	mu     sync.Mutex
+	lastMS uint64
+	hi     uint16 // top 16 of the 80 random bits
+	lo     uint64 // bottom 64 of the 80 random bits
+}
+
+var tradeIDs = &idGenerator{}
+
+// newTradeID returns a fresh, unique, time-ordered trade ID
+func newTradeID() string {
+	return tradeIDs.next(time.Now())
+}
+
+func (g *idGenerator) next(now time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	if ms <= g.lastMS {
+		// Same millisecond (or the clock went backwards): keep the last
+		// timestamp and increment, carrying into the timestamp on overflow
+		ms = g.lastMS
+		g.lo++
+		if g.lo == 0 {
+			g.hi++
+			if g.hi == 0 {
+				ms++
+			}
+		}
+	} else {
+		var b [10]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic("db: cannot read random bytes for trade ID: " + err.Error())
+		}
+		g.hi = binary.BigEndian.Uint16(b[0:2])
+		g.lo = binary.BigEndian.Uint64(b[2:10])
+	}
+	g.lastMS = ms
+
+	return encodeULID(ms, g.hi, g.lo)
+}
+
+// encodeULID writes the 128-bit value ms<<80 | hi<<64 | lo in base32, 5 bits per character
+func encodeULID(ms uint64, hi uint16, lo uint64) string {
+	// upper holds the top 64 bits: 48 of timestamp and 16 of randomness
+	upper := ms<<16 | uint64(hi)
+	var out [tradeIDLen]byte
+	for i := tradeIDLen - 1; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | upper<<59
+		upper >>= 5
+	}
+
+	return string(out[:])
+}
+
+// isLegacyID reports whether id was generated by the old content-hash scheme
+// (32 lowercase hex characters of an md5 digest)
+func isLegacyID(id string) bool {
+	if len(id) != legacyIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LegacyIDMigrator is implemented by stores that can re-key trades holding
+// legacy md5 IDs. Migrated trades get a new ID and their old ID is kept as an
+// alias, so clients holding the old ID can still read, update and delete them.
+type LegacyIDMigrator interface {
+	MigrateLegacyIDs() (int, error)
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTradeIDsAreSortableAndUnique(t *testing.T) {
+	g := &idGenerator{}
+	now := time.Unix(1600000000, 0)
+	seen := map[string]bool{}
+	prev := ""
+	for i := 0; i < 1000; i++ {
+		// Several IDs per millisecond, and a clock step backwards halfway through
+		at := now.Add(time.Duration(i/10) * time.Millisecond)
+		if i == 500 {
+			at = now
+		}
+		id := g.next(at)
+		assert.Len(t, id, tradeIDLen)
+		assert.Equal(t, "", strings.Trim(id, crockford), "IDs use the Crockford base32 alphabet")
+		assert.False(t, seen[id], "IDs must be unique")
+		assert.True(t, id > prev, "IDs must increase")
+		seen[id] = true
+		prev = id
+	}
+}
+
+func TestEncodeULID(t *testing.T) {
+	assert.Equal(t, "00000000000000000000000000", encodeULID(0, 0, 0))
+	assert.Equal(t, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ", encodeULID(1<<48-1, 1<<16-1, 1<<64-1))
+	assert.Equal(t, "0000000001"+"0000000000000000", encodeULID(1, 0, 0))
+}
+
+func TestIsLegacyID(t *testing.T) {
+	assert.True(t, isLegacyID("0123456789abcdef0123456789abcdef"))
+	assert.False(t, isLegacyID("0123456789ABCDEF0123456789ABCDEF"))
+	assert.False(t, isLegacyID(newTradeID()))
+	assert.False(t, isLegacyID("non-existent-key"))
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+// ErrKeyNotFound is returned when no stored API key matches
+var ErrKeyNotFound = errors.New("API key not found")
+
+// KeyStore ...storage of the API keys clients authenticate with. Only the
+// SHA-256 hash of a key is stored; the key itself is returned once, when it
+// is created. Keys belong to the book of the store that created them.
+type KeyStore interface {
+	// CreateAPIKey issues a new key of the book for clientID, with roles
+	CreateAPIKey(clientID string, admin bool, roles ...string) (model.IssuedAPIKey, error)
+	// Authenticate returns the stored key matching key, of any book, or ErrKeyNotFound
+	Authenticate(key string) (model.APIKey, error)
+	// ListAPIKeys returns every stored key of the book, oldest first
+	ListAPIKeys() ([]model.APIKey, error)
+	// RevokeAPIKey deletes the key of the book with the given ID, or returns ErrKeyNotFound
+	RevokeAPIKey(id string) error
+}
+
+// apiKeyPrefix marks API keys so that secret scanners can recognise them
+const apiKeyPrefix = "tk_"
+
+// HashAPIKey returns the hash a key is stored and looked up by. Keys are 256
+// random bits, so an unsalted fast hash is enough to make a leaked store useless.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a fresh random key
+func newAPIKey() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("db: cannot read random bytes for API key: " + err.Error())
+	}
+	return apiKeyPrefix + hex.EncodeToString(b)
+}
+
+// storedKey ...an API key with the hash it is looked up by
+type storedKey struct {
+	model.APIKey
+	Hash string `json:"hash"`
+}
+
+// issue returns k with a new key, and the record to store for it
+func issue(k model.APIKey) (model.IssuedAPIKey, storedKey) {
+	if len(k.Roles) == 0 {
+		k.Roles = nil
+	}
+	key := newAPIKey()
+	return model.IssuedAPIKey{APIKey: k, Key: key}, storedKey{APIKey: k, Hash: HashAPIKey(key)}
+}
+
+// CreateAPIKey ...issues a new key of the book for clientID, with roles
+func (s *MemoryStore) CreateAPIKey(clientID string, admin bool, roles ...string) (model.IssuedAPIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	issued, stored := issue(model.APIKey{ID: newTradeID(), Tenant: s.tenant, ClientID: clientID, Admin: admin, Roles: roles, CreatedAt: s.now().UTC()})
+	if err := s.commit([]op{{Kind: opKey, ID: stored.ID, Key: &stored}}); err != nil {
+		return model.IssuedAPIKey{}, err
+	}
+
+	return issued, nil
+}
+
+// Authenticate ...returns the stored key matching key, of any book
+func (s *MemoryStore) Authenticate(key string) (model.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if k, ok := s.keys[HashAPIKey(key)]; ok {
+		return k.APIKey, nil
+	}
+
+	return model.APIKey{}, ErrKeyNotFound
+}
+
+// ListAPIKeys ...returns every stored key of the book, oldest first
+func (s *MemoryStore) ListAPIKeys() ([]model.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []model.APIKey{}
+	for _, k := range s.keys {
+		if k.Tenant == s.tenant {
+			keys = append(keys, k.APIKey)
+		}
+	}
+	// Key IDs are ULIDs, so they sort by creation time
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys, nil
+}
+
+// RevokeAPIKey ...deletes the key of the book with the given ID
+func (s *MemoryStore) RevokeAPIKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.ID == id && k.Tenant == s.tenant {
+			return s.commit([]op{{Kind: opRevoke, ID: id}})
+		}
+	}
+
+	return ErrKeyNotFound
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"time"
+
+	"github.com/clear-street/backend-screening-parthingle/src/metrics"
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+var storeLatency = metrics.NewHistogram("trades_store_operation_duration_seconds",
+	"Latency of TradeStore operations by operation.", metrics.DefaultBuckets, "op")
+
+// instrumented ...TradeStore that records the latency of every operation of the store it wraps
+type instrumented struct {
+	TradeStore
+}
+
+// Instrument returns s with the latency of its operations recorded in the
+// trades_store_operation_duration_seconds metric. Only TradeStore methods
+// are forwarded, so optional interfaces such as io.Closer must be used on s.
+func Instrument(s TradeStore) TradeStore {
+	return instrumented{s}
+}
+
+// observe records the latency of an operation begun at start; deferred by each operation
+func observe(op string, start time.Time) {
+	storeLatency.Observe(time.Since(start).Seconds(), op)
+}
+
+func (s instrumented) GetAllTrades() ([]model.InternalTrade, error) {
+	defer observe("get_all_trades", time.Now())
+	return s.TradeStore.GetAllTrades()
+}
+
+func (s instrumented) QueryTrades(q TradeQuery) (TradePage, error) {
+	defer observe("query_trades", time.Now())
+	return s.TradeStore.QueryTrades(q)
+}
+
+func (s instrumented) GetTradeByID(id string) (model.InternalTrade, error) {
+	defer observe("get_trade_by_id", time.Now())
+	return s.TradeStore.GetTradeByID(id)
+}
+
+func (s instrumented) GetTradeByClientID(clientID string) (model.InternalTrade, error) {
+	defer observe("get_trade_by_client_id", time.Now())
+	return s.TradeStore.GetTradeByClientID(clientID)
+}
+
+func (s instrumented) DeleteTradeByID(id string, m Mutation) error {
+	defer observe("delete_trade", time.Now())
+	return s.TradeStore.DeleteTradeByID(id, m)
+}
+
+func (s instrumented) AtomicInsertTradesFromJSONArray(ts []byte, m Mutation) ([]model.TradeSubmitted, error) {
+	defer observe("insert_trades", time.Now())
+	return s.TradeStore.AtomicInsertTradesFromJSONArray(ts, m)
+}
+
+func (s instrumented) InsertEachTrade(trades []model.Trade, m Mutation) ([]model.TradeSubmitted, []error, error) {
+	defer observe("insert_each_trade", time.Now())
+	return s.TradeStore.InsertEachTrade(trades, m)
+}
+
+func (s instrumented) UpdateExistingTrade(t []byte, tradeID string, m Mutation) (model.InternalTrade, error) {
+	defer observe("update_trade", time.Now())
+	return s.TradeStore.UpdateExistingTrade(t, tradeID, m)
+}
+
+func (s instrumented) TradeHistory(id string) ([]model.TradeVersion, error) {
+	defer observe("trade_history", time.Now())
+	return s.TradeStore.TradeHistory(id)
+}
+
+func (s instrumented) TradeAsOf(id string, at time.Time) (model.InternalTrade, error) {
+	defer observe("trade_as_of", time.Now())
+	return s.TradeStore.TradeAsOf(id, at)
+}
+
+func (s instrumented) CountTrades() (int, error) {
+	defer observe("count_trades", time.Now())
+	return s.TradeStore.CountTrades()
+}
+
+func (s instrumented) TradeOwner(id string) (string, error) {
+	defer observe("trade_owner", time.Now())
+	return s.TradeStore.TradeOwner(id)
+}
+
+func (s instrumented) CreateAPIKey(clientID string, admin bool, roles ...string) (model.IssuedAPIKey, error) {
+	defer observe("create_api_key", time.Now())
+	return s.TradeStore.CreateAPIKey(clientID, admin, roles...)
+}
+
+func (s instrumented) Authenticate(key string) (model.APIKey, error) {
+	defer observe("authenticate", time.Now())
+	return s.TradeStore.Authenticate(key)
+}
+
+func (s instrumented) ListAPIKeys() ([]model.APIKey, error) {
+	defer observe("list_api_keys", time.Now())
+	return s.TradeStore.ListAPIKeys()
+}
+
+func (s instrumented) RevokeAPIKey(id string) error {
+	defer observe("revoke_api_key", time.Now())
+	return s.TradeStore.RevokeAPIKey(id)
+}
+
+func (s instrumented) Book(tenant string) TradeStore {
+	return instrumented{s.TradeStore.Book(tenant)}
+}
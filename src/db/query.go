@@ -0,0 +1,226 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+var (
+	// ErrInvalidQuery is returned for listing parameters the store cannot honor
+	ErrInvalidQuery = errors.New("bad query")
+	// ErrInvalidCursor is returned when a cursor is malformed or was issued for a different sort
+	ErrInvalidCursor = fmt.Errorf("%w: bad or expired cursor", ErrInvalidQuery)
+)
+
+// SortFields ...Trade fields a listing can be sorted by; "id" is the default
+var SortFields = []string{"id", "client_trade_id", "date", "quantity", "price", "ticker", "side", "account", "currency"}
+
+// TradeQuery ...filters, ordering and page of a trades listing. Zero values mean "no constraint".
+type TradeQuery struct {
+	Ticker         string
+	ClientIDPrefix string
+	// DateFrom and DateTo are inclusive YYYYMMDD bounds
+	DateFrom, DateTo int32
+	// Decimal bounds are inclusive; the zero Decimal means unbounded
+	PriceMin, PriceMax       model.Decimal
+	QuantityMin, QuantityMax model.Decimal
+	// Owner restricts the listing to the trades of one client
+	Owner string
+
+	// SortBy is one of SortFields; ties are always broken by id so ordering is stable
+	SortBy string
+	Desc   bool
+
+	// Limit caps the page size; 0 returns everything after Cursor
+	Limit  int
+	Cursor string
+}
+
+// TradePage ...one page of a listing; Next is empty on the last page
+type TradePage struct {
+	Trades []model.InternalTrade
+	Next   string
+}
+
+// cursor ...position after the last trade of a page
+type cursor struct {
+	SortBy string `json:"s"`
+	Desc   bool   `json:"d"`
+	Key    string `json:"k"`
+	ID     string `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	c := cursor{}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// ValidSortField reports whether name is one of SortFields
+func ValidSortField(name string) bool {
+	for _, f := range SortFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sortKey returns the value of field for t as a string
+func sortKey(field string, t model.InternalTrade) string {
+	switch field {
+	case "client_trade_id":
+		return t.Trade.ClientTradeID
+	case "date":
+		return strconv.Itoa(int(t.Trade.Date))
+	case "quantity":
+		return t.Trade.Quantity.String()
+	case "price":
+		return t.Trade.Price.String()
+	case "ticker":
+		return t.Trade.Ticker
+	case "side":
+		return string(t.Trade.Side)
+	case "account":
+		return t.Trade.Account
+	case "currency":
+		return t.Trade.Currency
+	}
+	return t.ID
+}
+
+// compareKeys orders two sort keys of field: numerically for numbers, bytewise otherwise
+func compareKeys(field, a, b string) int {
+	switch field {
+	case "date":
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case "quantity", "price":
+		x, _ := model.ParseDecimal(a)
+		y, _ := model.ParseDecimal(b)
+		return x.Cmp(y)
+	}
+	return strings.Compare(a, b)
+}
+
+// compare orders a trade (given by key and id) against another in q's ordering
+func (q TradeQuery) compare(keyA, idA, keyB, idB string) int {
+	c := compareKeys(q.SortBy, keyA, keyB)
+	if c == 0 {
+		c = strings.Compare(idA, idB)
+	}
+	if q.Desc {
+		c = -c
+	}
+	return c
+}
+
+// matches reports whether t satisfies every filter in q
+func (q TradeQuery) matches(t model.InternalTrade) bool {
+	tr := t.Trade
+	if len(q.Owner) > 0 && t.Owner != q.Owner {
+		return false
+	}
+	if len(q.Ticker) > 0 && tr.Ticker != q.Ticker {
+		return false
+	}
+	if len(q.ClientIDPrefix) > 0 && !strings.HasPrefix(tr.ClientTradeID, q.ClientIDPrefix) {
+		return false
+	}
+	if q.DateFrom != 0 && tr.Date < q.DateFrom {
+		return false
+	}
+	if q.DateTo != 0 && tr.Date > q.DateTo {
+		return false
+	}
+	if q.PriceMin.Valid() && tr.Price.Cmp(q.PriceMin) < 0 {
+		return false
+	}
+	if q.PriceMax.Valid() && tr.Price.Cmp(q.PriceMax) > 0 {
+		return false
+	}
+	if q.QuantityMin.Valid() && tr.Quantity.Cmp(q.QuantityMin) < 0 {
+		return false
+	}
+	if q.QuantityMax.Valid() && tr.Quantity.Cmp(q.QuantityMax) > 0 {
+		return false
+	}
+	return true
+}
+
+// paginate filters, sorts and pages trades according to q. Both stores use
+// it so that ordering and cursors behave identically across backends.
+func paginate(trades []model.InternalTrade, q TradeQuery) (TradePage, error) {
+	page := TradePage{Trades: []model.InternalTrade{}}
+	if len(q.SortBy) == 0 {
+		q.SortBy = "id"
+	}
+	if !ValidSortField(q.SortBy) {
+		return page, fmt.Errorf("%w: unknown sort field %q", ErrInvalidQuery, q.SortBy)
+	}
+	var after *cursor
+	if len(q.Cursor) > 0 {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if c.SortBy != q.SortBy || c.Desc != q.Desc {
+			return page, ErrInvalidCursor
+		}
+		after = &c
+	}
+
+	type keyed struct {
+		key   string
+		trade model.InternalTrade
+	}
+	rows := make([]keyed, 0, len(trades))
+	for _, t := range trades {
+		if !q.matches(t) {
+			continue
+		}
+		k := sortKey(q.SortBy, t)
+		if after != nil && q.compare(k, t.ID, after.Key, after.ID) <= 0 {
+			continue
+		}
+		rows = append(rows, keyed{key: k, trade: t})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return q.compare(rows[i].key, rows[i].trade.ID, rows[j].key, rows[j].trade.ID) < 0
+	})
+
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+		last := rows[len(rows)-1]
+		page.Next = encodeCursor(cursor{SortBy: q.SortBy, Desc: q.Desc, Key: last.key, ID: last.trade.ID})
+	}
+	for _, r := range rows {
+		page.Trades = append(page.Trades, r.trade)
+	}
+	return page, nil
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"time"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+// clientStore ...TradeStore in which only the trades owned by client exist.
+// A trade's owner never changes and trade IDs are never reused, so checking
+// the owner before forwarding a mutation cannot race with another mutation.
+type clientStore struct {
+	TradeStore
+	client string
+}
+
+// ForClient returns a view of s scoped to client: trades it did not post are
+// not found, listings only hold its trades and new trades are owned by it.
+// CountTrades and the KeyStore methods still cover the whole store.
+func ForClient(s TradeStore, client string) TradeStore {
+	return clientStore{TradeStore: s, client: client}
+}
+
+// owns returns ErrTradeNotFound unless trade id is owned by the client
+func (s clientStore) owns(id string) error {
+	owner, err := s.TradeStore.TradeOwner(id)
+	if err != nil {
+		return err
+	}
+	if owner != s.client {
+		return ErrTradeNotFound
+	}
+
+	return nil
+}
+
+// visible returns t, or ErrTradeNotFound if it is not owned by the client
+func (s clientStore) visible(t model.InternalTrade, err error) (model.InternalTrade, error) {
+	if err == nil && t.Owner != s.client {
+		return model.InternalTrade{}, ErrTradeNotFound
+	}
+
+	return t, err
+}
+
+func (s clientStore) Book(tenant string) TradeStore {
+	return ForClient(s.TradeStore.Book(tenant), s.client)
+}
+
+func (s clientStore) GetAllTrades() ([]model.InternalTrade, error) {
+	page, err := s.QueryTrades(TradeQuery{})
+
+	return page.Trades, err
+}
+
+func (s clientStore) QueryTrades(q TradeQuery) (TradePage, error) {
+	q.Owner = s.client
+	return s.TradeStore.QueryTrades(q)
+}
+
+func (s clientStore) GetTradeByID(id string) (model.InternalTrade, error) {
+	return s.visible(s.TradeStore.GetTradeByID(id))
+}
+
+func (s clientStore) GetTradeByClientID(clientID string) (model.InternalTrade, error) {
+	return s.visible(s.TradeStore.GetTradeByClientID(clientID))
+}
+
+func (s clientStore) TradeOwner(id string) (string, error) {
+	if err := s.owns(id); err != nil {
+		return "", err
+	}
+
+	return s.client, nil
+}
+
+func (s clientStore) DeleteTradeByID(id string, m Mutation) error {
+	if err := s.owns(id); err != nil {
+		return err
+	}
+
+	return s.TradeStore.DeleteTradeByID(id, m)
+}
+
+func (s clientStore) AtomicInsertTradesFromJSONArray(ts []byte, m Mutation) ([]model.TradeSubmitted, error) {
+	m.Owner = s.client
+	return s.TradeStore.AtomicInsertTradesFromJSONArray(ts, m)
+}
+
+func (s clientStore) InsertEachTrade(trades []model.Trade, m Mutation) ([]model.TradeSubmitted, []error, error) {
+	m.Owner = s.client
+	return s.TradeStore.InsertEachTrade(trades, m)
+}
+
+func (s clientStore) UpdateExistingTrade(t []byte, tradeID string, m Mutation) (model.InternalTrade, error) {
+	if err := s.owns(tradeID); err != nil {
+		return model.InternalTrade{}, err
+	}
+
+	return s.TradeStore.UpdateExistingTrade(t, tradeID, m)
+}
+
+func (s clientStore) TradeHistory(id string) ([]model.TradeVersion, error) {
+	if err := s.owns(id); err != nil {
+		return []model.TradeVersion{}, err
+	}
+
+	return s.TradeStore.TradeHistory(id)
+}
+
+func (s clientStore) TradeAsOf(id string, at time.Time) (model.InternalTrade, error) {
+	if err := s.owns(id); err != nil {
+		return model.InternalTrade{}, err
+	}
+
+	return s.TradeStore.TradeAsOf(id, at)
+}
@@ -0,0 +1,685 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// migrations are applied in order and recorded in schema_migrations; never
+// edit an entry that has shipped, append a new one instead
+var migrations = []string{
+	// 1: trades table; ticker and client_trade_id are each unique across the book
+	`CREATE TABLE trades (
+		id              TEXT    PRIMARY KEY,
+		client_trade_id TEXT    NOT NULL,
+		date            INTEGER NOT NULL,
+		quantity        TEXT    NOT NULL,
+		price           TEXT    NOT NULL,
+		ticker          TEXT    NOT NULL
+	);
+	CREATE UNIQUE INDEX trades_client_trade_id ON trades (client_trade_id);
+	CREATE UNIQUE INDEX trades_ticker ON trades (ticker);`,
+	// 2: v2 API fields; empty for trades booked through v1
+	`ALTER TABLE trades ADD COLUMN side TEXT NOT NULL DEFAULT '';
+	ALTER TABLE trades ADD COLUMN account TEXT NOT NULL DEFAULT '';
+	ALTER TABLE trades ADD COLUMN currency TEXT NOT NULL DEFAULT '';`,
+	// 3: legacy md5 IDs of re-keyed trades, resolved to their current ID
+	`CREATE TABLE trade_id_aliases (
+		legacy_id TEXT PRIMARY KEY,
+		id        TEXT NOT NULL
+	);`,
+	// 4: immutable history of every trade mutation, kept after the trade is deleted
+	`CREATE TABLE trade_versions (
+		trade_id    TEXT    NOT NULL,
+		version     INTEGER NOT NULL,
+		action      TEXT    NOT NULL,
+		actor       TEXT    NOT NULL,
+		reason      TEXT    NOT NULL,
+		at          INTEGER NOT NULL,
+		before_json TEXT,
+		after_json  TEXT,
+		PRIMARY KEY (trade_id, version)
+	);
+	CREATE TRIGGER trade_versions_no_update BEFORE UPDATE ON trade_versions
+	BEGIN SELECT RAISE(ABORT, 'trade versions are immutable'); END;
+	CREATE TRIGGER trade_versions_no_delete BEFORE DELETE ON trade_versions
+	BEGIN SELECT RAISE(ABORT, 'trade versions are immutable'); END;`,
+	// 5: the client owning each trade, kept after the trade is deleted, and
+	// the SHA-256 hashes of the API keys clients authenticate with
+	`CREATE TABLE trade_owners (
+		trade_id TEXT PRIMARY KEY,
+		owner    TEXT NOT NULL
+	);
+	CREATE INDEX trade_owners_owner ON trade_owners (owner);
+	CREATE TABLE api_keys (
+		id         TEXT    PRIMARY KEY,
+		hash       TEXT    NOT NULL UNIQUE,
+		client_id  TEXT    NOT NULL,
+		admin      INTEGER NOT NULL,
+		created_at INTEGER NOT NULL
+	);`,
+	// 6: separate books of trades per tenant; ticker and client_trade_id are
+	// each unique within a book. Existing rows are in the 'default' book, and
+	// trade_owners keeps the book of deleted trades.
+	`ALTER TABLE trades ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+	DROP INDEX trades_client_trade_id;
+	DROP INDEX trades_ticker;
+	CREATE UNIQUE INDEX trades_tenant_client_trade_id ON trades (tenant, client_trade_id);
+	CREATE UNIQUE INDEX trades_tenant_ticker ON trades (tenant, ticker);
+	ALTER TABLE trade_owners ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+	ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+	CREATE INDEX api_keys_tenant ON api_keys (tenant);`,
+	// 7: comma-separated roles of each API key
+	`ALTER TABLE api_keys ADD COLUMN roles TEXT NOT NULL DEFAULT '';`,
+}
+
+// SQLStore is a TradeStore backed by an embedded, pure-Go SQLite database
+type SQLStore struct {
+	db  *sql.DB
+	now func() time.Time
+	// tenant is the book this store reads and writes
+	tenant string
+}
+
+// OpenSQLStore opens (creating if needed) the database at path and migrates
+// it to the latest schema. Use ":memory:" for a throwaway database.
+func OpenSQLStore(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes transactions, matching MemoryStore semantics,
+	// and keeps ":memory:" databases from being split across connections.
+	db.SetMaxOpenConns(1)
+	s := &SQLStore{db: db, now: time.Now, tenant: DefaultTenant}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the underlying database, and so the store of every book
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Book ...the store of tenant's book; it shares its database with s
+func (s *SQLStore) Book(tenant string) TradeStore {
+	return &SQLStore{db: s.db, now: s.now, tenant: tenant}
+}
+
+func (s *SQLStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for v := current + 1; v <= len(migrations); v++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[v-1]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, v); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("migrated trade database", "version", v)
+	}
+
+	return nil
+}
+
+// isConstraintError reports whether err is a SQLite uniqueness/primary key violation
+func isConstraintError(err error) bool {
+	var e *sqlite.Error
+	if errors.As(err, &e) {
+		return e.Code()&0xff == sqlite3.SQLITE_CONSTRAINT
+	}
+
+	return false
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTrade(row scanner) (model.InternalTrade, error) {
+	ret := model.InternalTrade{}
+	t := &ret.Trade
+	err := row.Scan(&ret.ID, &t.ClientTradeID, &t.Date, &t.Quantity, &t.Price, &t.Ticker, &t.Side, &t.Account, &t.Currency, &ret.Version, &ret.Owner)
+
+	return ret, err
+}
+
+const selectTrades = `SELECT id, client_trade_id, date, quantity, price, ticker, side, account, currency,
+	(SELECT COALESCE(MAX(v.version), 0) FROM trade_versions v WHERE v.trade_id = trades.id),
+	COALESCE((SELECT o.owner FROM trade_owners o WHERE o.trade_id = trades.id), '') FROM trades`
+
+// GetAllTrades ... used by HandleFunc GET /v1/trades
+func (s *SQLStore) GetAllTrades() ([]model.InternalTrade, error) {
+	return s.queryTrades(selectTrades+` WHERE tenant = ? ORDER BY rowid`, s.tenant)
+}
+
+// CountTrades ...used by the trades_stored metric; counts the trades of every book
+func (s *SQLStore) CountTrades() (int, error) {
+	n := 0
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM trades`).Scan(&n)
+
+	return n, err
+}
+
+// QueryTrades ...used by HandleFunc GET /v1/trades with filters, sorting and pagination.
+// Exact-match and range filters on text and integer columns are pushed down to
+// SQL; decimal ranges, ordering and cursors are applied by paginate since
+// quantity and price are stored as exact text.
+func (s *SQLStore) QueryTrades(q TradeQuery) (TradePage, error) {
+	where := []string{`tenant = ?`}
+	args := []interface{}{s.tenant}
+	if len(q.Owner) > 0 {
+		where = append(where, `id IN (SELECT trade_id FROM trade_owners WHERE owner = ?)`)
+		args = append(args, q.Owner)
+	}
+	if len(q.Ticker) > 0 {
+		where = append(where, `ticker = ?`)
+		args = append(args, q.Ticker)
+	}
+	if len(q.ClientIDPrefix) > 0 {
+		where = append(where, `substr(client_trade_id, 1, ?) = ?`)
+		args = append(args, len(q.ClientIDPrefix), q.ClientIDPrefix)
+	}
+	if q.DateFrom != 0 {
+		where = append(where, `date >= ?`)
+		args = append(args, q.DateFrom)
+	}
+	if q.DateTo != 0 {
+		where = append(where, `date <= ?`)
+		args = append(args, q.DateTo)
+	}
+	trades, err := s.queryTrades(selectTrades+` WHERE `+strings.Join(where, ` AND `), args...)
+	if err != nil {
+		return TradePage{Trades: []model.InternalTrade{}}, err
+	}
+
+	return paginate(trades, q)
+}
+
+func (s *SQLStore) queryTrades(query string, args ...interface{}) ([]model.InternalTrade, error) {
+	trades := []model.InternalTrade{}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return trades, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTrade(rows)
+		if err != nil {
+			return trades, err
+		}
+		trades = append(trades, t)
+	}
+
+	return trades, rows.Err()
+}
+
+// byID matches a trade of book ?2 by its current ID or by a legacy ID it was migrated from
+const byID = ` WHERE id = COALESCE((SELECT id FROM trade_id_aliases WHERE legacy_id = ?1), ?1) AND tenant = ?2`
+
+// GetTradeByID ...used by HandleFunc GET /v1/trades/{trade_id}
+func (s *SQLStore) GetTradeByID(id string) (model.InternalTrade, error) {
+	ret, err := scanTrade(s.db.QueryRow(selectTrades+byID, id, s.tenant))
+	if err == sql.ErrNoRows {
+		return model.InternalTrade{}, ErrTradeNotFound
+	}
+
+	return ret, err
+}
+
+// TradeOwner ...the client that posted trade id
+func (s *SQLStore) TradeOwner(id string) (string, error) {
+	var owner sql.NullString
+	var exists bool
+	err := s.db.QueryRow(`SELECT o.owner,
+		(EXISTS (SELECT 1 FROM trades WHERE id = r.id) OR EXISTS (SELECT 1 FROM trade_versions WHERE trade_id = r.id))
+			AND COALESCE(o.tenant, 'default') = ?2
+		FROM (SELECT COALESCE((SELECT id FROM trade_id_aliases WHERE legacy_id = ?1), ?1) AS id) r
+		LEFT JOIN trade_owners o ON o.trade_id = r.id`, id, s.tenant).Scan(&owner, &exists)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrTradeNotFound
+	}
+
+	return owner.String, nil
+}
+
+// GetTradeByClientID ...used by HandleFunc /v1/trades/by-client-id/{client_trade_id}
+func (s *SQLStore) GetTradeByClientID(clientID string) (model.InternalTrade, error) {
+	ret, err := scanTrade(s.db.QueryRow(selectTrades+` WHERE tenant = ? AND client_trade_id = ?`, s.tenant, clientID))
+	if err == sql.ErrNoRows {
+		return model.InternalTrade{}, ErrTradeNotFound
+	}
+
+	return ret, err
+}
+
+// DeleteTradeByID ...used by HandleFunc DELETE /v1/trades/{trade_id}
+func (s *SQLStore) DeleteTradeByID(id string, m Mutation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := scanTrade(tx.QueryRow(selectTrades+byID, id, s.tenant))
+	if err == sql.ErrNoRows {
+		return ErrTradeNotFound
+	} else if err != nil {
+		return err
+	}
+	if !m.allows(old.Version) {
+		return ErrVersionMismatch
+	}
+	if _, err := tx.Exec(`DELETE FROM trades WHERE id = ?`, old.ID); err != nil {
+		return err
+	}
+	if err := s.insertVersion(tx, old.ID, model.ActionDeleted, &old.Trade, nil, m); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) insertTrade(tx *sql.Tx, id string, t model.Trade) error {
+	_, err := tx.Exec(`INSERT INTO trades (id, tenant, client_trade_id, date, quantity, price, ticker, side, account, currency) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, s.tenant, t.ClientTradeID, t.Date, t.Quantity, t.Price, t.Ticker, string(t.Side), t.Account, t.Currency)
+	if isConstraintError(err) {
+		return ErrDuplicateTrade
+	}
+
+	return err
+}
+
+// insertOwner records the book and m's Owner of new trade id
+func (s *SQLStore) insertOwner(tx *sql.Tx, id string, m Mutation) error {
+	_, err := tx.Exec(`INSERT INTO trade_owners (trade_id, owner, tenant) VALUES (?, ?, ?)`, id, m.Owner, s.tenant)
+
+	return err
+}
+
+// countBook returns the number of trades in the book as seen by tx
+func (s *SQLStore) countBook(tx *sql.Tx) (int, error) {
+	n := 0
+	err := tx.QueryRow(`SELECT COUNT(*) FROM trades WHERE tenant = ?`, s.tenant).Scan(&n)
+
+	return n, err
+}
+
+// AtomicInsertTradesFromJSONArray ...used by HandleFunc POST /v1/trades
+func (s *SQLStore) AtomicInsertTradesFromJSONArray(ts []byte, m Mutation) ([]model.TradeSubmitted, error) {
+	res := []model.TradeSubmitted{}
+	trades, err := model.FromJSON(ts)
+	if err != nil {
+		return res, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+	for i := range trades {
+		t := trades[i]
+		tradeID := newTradeID()
+		if err := s.insertTrade(tx, tradeID, t); err != nil {
+			return []model.TradeSubmitted{}, err
+		}
+		if err := s.insertVersion(tx, tradeID, model.ActionCreated, nil, &t, m); err != nil {
+			return []model.TradeSubmitted{}, err
+		}
+		if err := s.insertOwner(tx, tradeID, m); err != nil {
+			return []model.TradeSubmitted{}, err
+		}
+		res = append(res, model.TradeSubmitted{ClientTradeID: t.ClientTradeID, TradeID: tradeID})
+	}
+	// Counted once the trades are in, so that duplicates are reported first
+	if m.MaxTrades > 0 {
+		n, err := s.countBook(tx)
+		if err != nil {
+			return []model.TradeSubmitted{}, err
+		}
+		if !m.fits(n, 0) {
+			return []model.TradeSubmitted{}, ErrQuotaExceeded
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return []model.TradeSubmitted{}, err
+	}
+
+	return res, nil
+}
+
+// InsertEachTrade ...used by HandleFunc POST /v1/trades?atomic=false
+func (s *SQLStore) InsertEachTrade(trades []model.Trade, m Mutation) ([]model.TradeSubmitted, []error, error) {
+	res := make([]model.TradeSubmitted, len(trades))
+	errs := make([]error, len(trades))
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	count, err := s.countBook(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range trades {
+		t := trades[i]
+		if !m.fits(count, 1) {
+			errs[i] = ErrQuotaExceeded
+			continue
+		}
+		tradeID := newTradeID()
+		// A constraint violation only rolls back its own statement, so the
+		// transaction carries on with the next trade
+		if err := s.insertTrade(tx, tradeID, t); err == ErrDuplicateTrade {
+			errs[i] = err
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if err := s.insertVersion(tx, tradeID, model.ActionCreated, nil, &t, m); err != nil {
+			return nil, nil, err
+		}
+		if err := s.insertOwner(tx, tradeID, m); err != nil {
+			return nil, nil, err
+		}
+		count++
+		res[i] = model.TradeSubmitted{ClientTradeID: t.ClientTradeID, TradeID: tradeID}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return res, errs, nil
+}
+
+// UpdateExistingTrade ...used by HandleFunc PUT /v1/trades/
+func (s *SQLStore) UpdateExistingTrade(t []byte, tradeID string, m Mutation) (model.InternalTrade, error) {
+	ret := model.InternalTrade{}
+	trade, parseErr := model.TradeFromJSON(t)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ret, err
+	}
+	defer tx.Rollback()
+	old, err := scanTrade(tx.QueryRow(selectTrades+byID, tradeID, s.tenant))
+	if err == sql.ErrNoRows {
+		return ret, ErrTradeNotFound
+	} else if err != nil {
+		return ret, err
+	}
+	id := old.ID
+	if !m.allows(old.Version) {
+		return ret, ErrVersionMismatch
+	}
+	if parseErr != nil {
+		return ret, parseErr
+	}
+	// The trade keeps its ID; only its fields change
+	_, err = tx.Exec(`UPDATE trades SET client_trade_id = ?, date = ?, quantity = ?, price = ?, ticker = ?, side = ?, account = ?, currency = ? WHERE id = ?`,
+		trade.ClientTradeID, trade.Date, trade.Quantity, trade.Price, trade.Ticker, string(trade.Side), trade.Account, trade.Currency, id)
+	if isConstraintError(err) {
+		return ret, ErrDuplicateTrade
+	} else if err != nil {
+		return ret, err
+	}
+	if err := s.insertVersion(tx, id, model.ActionUpdated, &old.Trade, &trade, m); err != nil {
+		return ret, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ret, err
+	}
+	ret.Trade = trade
+	ret.ID = id
+	ret.Version = old.Version + 1
+	ret.Owner = old.Owner
+
+	return ret, nil
+}
+
+// MigrateLegacyIDs re-keys every trade stored under a legacy md5 ID and
+// records the old ID as an alias. It returns the number of trades migrated.
+func (s *SQLStore) MigrateLegacyIDs() (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT id FROM trades WHERE length(id) = ?`, legacyIDLen)
+	if err != nil {
+		return 0, err
+	}
+	legacy := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if isLegacyID(id) {
+			legacy = append(legacy, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, old := range legacy {
+		id := newTradeID()
+		if _, err := tx.Exec(`UPDATE trades SET id = ? WHERE id = ?`, id, old); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`INSERT INTO trade_id_aliases (legacy_id, id) VALUES (?, ?)`, old, id); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE trade_owners SET trade_id = ? WHERE trade_id = ?`, id, old); err != nil {
+			return 0, err
+		}
+		// Versions are immutable, so they are copied to the new ID rather than re-keyed
+		if _, err := tx.Exec(`INSERT INTO trade_versions (trade_id, version, action, actor, reason, at, before_json, after_json)
+			SELECT ?, version, action, actor, reason, at, before_json, after_json FROM trade_versions WHERE trade_id = ?`, id, old); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(legacy), nil
+}
+
+// tradeColumn encodes an optional trade for a JSON text column
+func tradeColumn(t *model.Trade) (interface{}, error) {
+	if t == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// insertVersion records the next version of trade id in tx
+func (s *SQLStore) insertVersion(tx *sql.Tx, id string, action model.Action, before, after *model.Trade, m Mutation) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM trade_versions WHERE trade_id = ?`, id).Scan(&n); err != nil {
+		return err
+	}
+	b, err := tradeColumn(before)
+	if err != nil {
+		return err
+	}
+	a, err := tradeColumn(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO trade_versions (trade_id, version, action, actor, reason, at, before_json, after_json) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, n+1, string(action), m.Actor, m.Reason, s.now().UnixNano(), b, a)
+
+	return err
+}
+
+func (s *SQLStore) versions(id string) ([]model.TradeVersion, error) {
+	versions := []model.TradeVersion{}
+	rows, err := s.db.Query(`SELECT trade_id, version, action, actor, reason, at, before_json, after_json FROM trade_versions
+		WHERE trade_id = COALESCE((SELECT id FROM trade_id_aliases WHERE legacy_id = ?1), ?1)
+		AND COALESCE((SELECT tenant FROM trade_owners WHERE trade_id = trade_versions.trade_id), 'default') = ?2
+		ORDER BY version`, id, s.tenant)
+	if err != nil {
+		return versions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		v := model.TradeVersion{}
+		var at int64
+		var before, after sql.NullString
+		if err := rows.Scan(&v.TradeID, &v.Version, &v.Action, &v.Actor, &v.Reason, &at, &before, &after); err != nil {
+			return versions, err
+		}
+		v.At = time.Unix(0, at).UTC()
+		if before.Valid {
+			v.Before = &model.Trade{}
+			if err := json.Unmarshal([]byte(before.String), v.Before); err != nil {
+				return versions, err
+			}
+		}
+		if after.Valid {
+			v.After = &model.Trade{}
+			if err := json.Unmarshal([]byte(after.String), v.After); err != nil {
+				return versions, err
+			}
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+// TradeHistory ...used by HandleFunc GET /v1/trades/{trade_id}/history
+func (s *SQLStore) TradeHistory(id string) ([]model.TradeVersion, error) {
+	versions, err := s.versions(id)
+	if err != nil || len(versions) > 0 {
+		return versions, err
+	}
+	if _, err := s.GetTradeByID(id); err != nil {
+		return versions, err
+	}
+
+	return versions, nil
+}
+
+// TradeAsOf ...used by HandleFunc GET /v1/trades/{trade_id}?as_of=
+func (s *SQLStore) TradeAsOf(id string, at time.Time) (model.InternalTrade, error) {
+	versions, err := s.versions(id)
+	if err != nil {
+		return model.InternalTrade{}, err
+	}
+	if len(versions) == 0 {
+		// Booked before history was kept, so it is assumed to have always looked like this
+		return s.GetTradeByID(id)
+	}
+
+	return tradeAsOf(versions[0].TradeID, versions, at)
+}
+
+// CreateAPIKey ...issues a new key of the book for clientID, with roles
+func (s *SQLStore) CreateAPIKey(clientID string, admin bool, roles ...string) (model.IssuedAPIKey, error) {
+	issued, stored := issue(model.APIKey{ID: newTradeID(), Tenant: s.tenant, ClientID: clientID, Admin: admin, Roles: roles, CreatedAt: s.now().UTC()})
+	_, err := s.db.Exec(`INSERT INTO api_keys (id, tenant, hash, client_id, admin, roles, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		stored.ID, stored.Tenant, stored.Hash, stored.ClientID, stored.Admin, strings.Join(stored.Roles, ","), stored.CreatedAt.UnixNano())
+	if err != nil {
+		return model.IssuedAPIKey{}, err
+	}
+
+	return issued, nil
+}
+
+const selectAPIKeys = `SELECT id, tenant, client_id, admin, roles, created_at FROM api_keys`
+
+func scanAPIKey(row scanner) (model.APIKey, error) {
+	k := model.APIKey{}
+	var created int64
+	var roles string
+	if err := row.Scan(&k.ID, &k.Tenant, &k.ClientID, &k.Admin, &roles, &created); err != nil {
+		return k, err
+	}
+	if len(roles) > 0 {
+		k.Roles = strings.Split(roles, ",")
+	}
+	k.CreatedAt = time.Unix(0, created).UTC()
+
+	return k, nil
+}
+
+// Authenticate ...returns the stored key matching key, of any book
+func (s *SQLStore) Authenticate(key string) (model.APIKey, error) {
+	k, err := scanAPIKey(s.db.QueryRow(selectAPIKeys+` WHERE hash = ?`, HashAPIKey(key)))
+	if err == sql.ErrNoRows {
+		return model.APIKey{}, ErrKeyNotFound
+	}
+
+	return k, err
+}
+
+// ListAPIKeys ...returns every stored key of the book, oldest first
+func (s *SQLStore) ListAPIKeys() ([]model.APIKey, error) {
+	keys := []model.APIKey{}
+	rows, err := s.db.Query(selectAPIKeys+` WHERE tenant = ? ORDER BY id`, s.tenant)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey ...deletes the key of the book with the given ID
+func (s *SQLStore) RevokeAPIKey(id string) error {
+	res, err := s.db.Exec(`DELETE FROM api_keys WHERE id = ? AND tenant = ?`, id, s.tenant)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,633 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// forEachStore runs fn against a fresh instance of every TradeStore backend
+func forEachStore(t *testing.T, fn func(t *testing.T, s TradeStore)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore())
+	})
+	t.Run("file", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		fs, err := OpenFileStore(FileOptions{Dir: dir, Fsync: FsyncNever})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Close()
+		fn(t, fs)
+	})
+	t.Run("sql", func(t *testing.T) {
+		ss, err := OpenSQLStore(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ss.Close()
+		fn(t, ss)
+	})
+}
+
+func TestStoreInsertGetDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		JSON := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
+		key, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+		assert.Nil(t, err)
+		assert.Equal(t, "12345", key[0].ClientTradeID)
+
+		got, err := s.GetTradeByID(key[0].TradeID)
+		assert.Nil(t, err)
+		assert.Equal(t, "PRTH", got.Trade.Ticker)
+
+		all, err := s.GetAllTrades()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(all))
+
+		assert.Nil(t, s.DeleteTradeByID(key[0].TradeID, Mutation{}))
+		_, err = s.GetTradeByID(key[0].TradeID)
+		assert.Equal(t, "trade not found", err.Error())
+		assert.Equal(t, "trade not found", s.DeleteTradeByID(key[0].TradeID, Mutation{}).Error())
+	})
+}
+
+func TestStoreBatchInsertIsAtomic(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		_, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{})
+		assert.Nil(t, err)
+
+		JSON := []byte(`[{"client_trade_id":"2","date":20010101,"quantity":"1","price":"1","ticker":"AMZN"},{"client_trade_id":"3","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`)
+		_, err = s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+		assert.Equal(t, "contains trade with already existing ticker or client ID", err.Error())
+
+		JSON = []byte(`[{"client_trade_id":"4","date":20010101,"quantity":"1","price":"1","ticker":"AAPL"},{"client_trade_id":"4","date":20010101,"quantity":"1","price":"1","ticker":"MSFT"}]`)
+		_, err = s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+		assert.Equal(t, "contains trade with already existing ticker or client ID", err.Error())
+
+		all, _ := s.GetAllTrades()
+		assert.Equal(t, 1, len(all), "Rejected batches must not be partially inserted")
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		keys, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"},{"client_trade_id":"2","date":20010101,"quantity":"1","price":"1","ticker":"AMZN"}]`), Mutation{})
+		assert.Nil(t, err)
+
+		_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"9","date":20010101,"quantity":"1","price":"1","ticker":"X"}`), "missing", Mutation{})
+		assert.Equal(t, "trade not found", err.Error())
+
+		_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"9","date":20010101,"quantity":"1","price":"1","ticker":"AMZN"}`), keys[0].TradeID, Mutation{})
+		assert.Equal(t, "contains trade with already existing ticker or client ID", err.Error())
+		_, err = s.GetTradeByID(keys[0].TradeID)
+		assert.Nil(t, err, "A rejected update must leave the original trade in place")
+
+		_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"9","date":2,"quantity":"1","price":"1","ticker":"X"}`), keys[0].TradeID, Mutation{})
+		assert.Equal(t, "bad or missing date", err.Error())
+
+		ret, err := s.UpdateExistingTrade([]byte(`{"client_trade_id":"1","date":20010102,"quantity":"5","price":"1","ticker":"PRTH"}`), keys[0].TradeID, Mutation{})
+		assert.Nil(t, err, "A trade may keep its own ticker and client ID")
+		assert.Equal(t, keys[0].TradeID, ret.ID, "Updates must not change the trade ID")
+		got, err := s.GetTradeByID(ret.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, "5", got.Trade.Quantity.String())
+	})
+}
+
+const legacyID = "0123456789abcdef0123456789abcdef"
+
+// seedLegacyTrade stores t under legacyID the way pre-ULID versions did
+func seedLegacyTrade(t *testing.T, s TradeStore, tr model.Trade) {
+	switch st := s.(type) {
+	case *MemoryStore:
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		assert.Nil(t, st.commit([]op{{Kind: opPut, ID: legacyID, Trade: tr}}))
+	case *FileStore:
+		seedLegacyTrade(t, st.MemoryStore, tr)
+	case *SQLStore:
+		tx, err := st.db.Begin()
+		assert.Nil(t, err)
+		assert.Nil(t, st.insertTrade(tx, legacyID, tr))
+		assert.Nil(t, tx.Commit())
+	default:
+		t.Fatalf("no legacy seeding for %T", s)
+	}
+}
+
+func TestStoreMigratesLegacyIDs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		seedLegacyTrade(t, s, fsTrade("PRTH"))
+		keys, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"2","date":20010101,"quantity":"1","price":"1","ticker":"AMZN"}]`), Mutation{})
+		assert.Nil(t, err)
+		_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"PRTH","date":20010102,"quantity":"2","price":"1","ticker":"PRTH"}`), legacyID, Mutation{})
+		assert.Nil(t, err)
+
+		m := s.(LegacyIDMigrator)
+		n, err := m.MigrateLegacyIDs()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		n, err = m.MigrateLegacyIDs()
+		assert.Nil(t, err)
+		assert.Equal(t, 0, n, "Migration should be a no-op once done")
+
+		migrated, err := s.GetTradeByClientID("PRTH")
+		assert.Nil(t, err)
+		assert.Len(t, migrated.ID, tradeIDLen)
+		got, err := s.GetTradeByID(legacyID)
+		assert.Nil(t, err, "Legacy IDs should still resolve")
+		assert.Equal(t, migrated.ID, got.ID)
+		got, err = s.GetTradeByID(keys[0].TradeID)
+		assert.Nil(t, err, "Trades with current IDs are left alone")
+		assert.Equal(t, "AMZN", got.Trade.Ticker)
+
+		ret, err := s.UpdateExistingTrade([]byte(`{"client_trade_id":"PRTH","date":20010102,"quantity":"3","price":"1","ticker":"PRTH"}`), legacyID, Mutation{})
+		assert.Nil(t, err)
+		assert.Equal(t, migrated.ID, ret.ID)
+		history, err := s.TradeHistory(legacyID)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(history), "Versions recorded under the legacy ID should be kept")
+		for i, v := range history {
+			assert.Equal(t, migrated.ID, v.TradeID)
+			assert.Equal(t, i+1, v.Version)
+		}
+		assert.Equal(t, "2", history[0].After.Quantity.String())
+
+		assert.Nil(t, s.DeleteTradeByID(legacyID, Mutation{}))
+		_, err = s.GetTradeByID(migrated.ID)
+		assert.Equal(t, ErrTradeNotFound, err)
+	})
+}
+
+func TestSQLStoreMigrationsAreIdempotent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trades.sqlite")
+
+	s, err := OpenSQLStore(path)
+	assert.Nil(t, err)
+	_, err = s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+
+	s, err = OpenSQLStore(path)
+	assert.Nil(t, err, "Reopening an up-to-date database should not re-run migrations")
+	defer s.Close()
+	all, _ := s.GetAllTrades()
+	assert.Equal(t, 1, len(all))
+	var version int
+	assert.Nil(t, s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, len(migrations), version)
+}
+
+func seedQueryTrades(t *testing.T, s TradeStore) {
+	JSON := []byte(`[
+		{"client_trade_id":"A-1","date":20200101,"quantity":"10","price":"9.5","ticker":"AAPL"},
+		{"client_trade_id":"A-2","date":20200102,"quantity":"200","price":"10.00","ticker":"AMZN"},
+		{"client_trade_id":"B-1","date":20200103,"quantity":"30","price":"100","ticker":"MSFT"},
+		{"client_trade_id":"B-2","date":20200104,"quantity":"-5","price":"10","ticker":"PRTH"},
+		{"client_trade_id":"C-1","date":20200105,"quantity":"7","price":"0.99","ticker":"GOOG"}]`)
+	_, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tickers(trades []model.InternalTrade) []string {
+	ret := []string{}
+	for _, t := range trades {
+		ret = append(ret, t.Trade.Ticker)
+	}
+	return ret
+}
+
+func TestStoreQueryFiltersAndSorts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		seedQueryTrades(t, s)
+
+		page, err := s.QueryTrades(TradeQuery{SortBy: "price"})
+		assert.Nil(t, err)
+		// AMZN and PRTH tie on price and are ordered by id
+		assert.Equal(t, []string{"GOOG", "AAPL"}, tickers(page.Trades)[:2], "Prices sort numerically")
+		assert.Equal(t, "MSFT", page.Trades[4].Trade.Ticker)
+
+		page, err = s.QueryTrades(TradeQuery{SortBy: "quantity", Desc: true})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"AMZN", "MSFT", "AAPL", "GOOG", "PRTH"}, tickers(page.Trades))
+
+		page, err = s.QueryTrades(TradeQuery{ClientIDPrefix: "A-", SortBy: "date"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"AAPL", "AMZN"}, tickers(page.Trades))
+
+		page, err = s.QueryTrades(TradeQuery{DateFrom: 20200102, DateTo: 20200104, SortBy: "date", Desc: true})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"PRTH", "MSFT", "AMZN"}, tickers(page.Trades))
+
+		page, err = s.QueryTrades(TradeQuery{PriceMin: model.MustParseDecimal("10"), PriceMax: model.MustParseDecimal("10.000"), SortBy: "ticker"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"AMZN", "PRTH"}, tickers(page.Trades), "Price bounds are inclusive and numeric")
+
+		page, err = s.QueryTrades(TradeQuery{Ticker: "MSFT", QuantityMin: model.MustParseDecimal("1")})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"MSFT"}, tickers(page.Trades))
+
+		_, err = s.QueryTrades(TradeQuery{SortBy: "nope"})
+		assert.True(t, errors.Is(err, ErrInvalidQuery))
+	})
+}
+
+func TestStoreQueryPaginatesStably(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		seedQueryTrades(t, s)
+
+		seen := []string{}
+		q := TradeQuery{SortBy: "price", Limit: 2}
+		for pages := 0; ; pages++ {
+			page, err := s.QueryTrades(q)
+			assert.Nil(t, err)
+			assert.True(t, len(page.Trades) <= 2)
+			seen = append(seen, tickers(page.Trades)...)
+			if len(page.Next) == 0 {
+				assert.Equal(t, 2, pages)
+				break
+			}
+			q.Cursor = page.Next
+		}
+		assert.Equal(t, []string{"GOOG", "AAPL"}, seen[:2])
+		assert.Equal(t, "MSFT", seen[4])
+		assert.ElementsMatch(t, []string{"GOOG", "AAPL", "AMZN", "PRTH", "MSFT"}, seen, "Every trade appears exactly once")
+
+		page, _ := s.QueryTrades(TradeQuery{SortBy: "price", Limit: 2})
+		_, err := s.QueryTrades(TradeQuery{SortBy: "date", Limit: 2, Cursor: page.Next})
+		assert.Equal(t, ErrInvalidCursor, err, "A cursor only continues the sort it was issued for")
+		_, err = s.QueryTrades(TradeQuery{Cursor: "!!!"})
+		assert.Equal(t, ErrInvalidCursor, err)
+	})
+}
+
+func TestStoreGetTradeByClientID(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		keys, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"T-1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{})
+		assert.Nil(t, err)
+
+		got, err := s.GetTradeByClientID("T-1")
+		assert.Nil(t, err)
+		assert.Equal(t, keys[0].TradeID, got.ID)
+		assert.Equal(t, "PRTH", got.Trade.Ticker)
+
+		ret, err := s.UpdateExistingTrade([]byte(`{"client_trade_id":"T-2","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}`), got.ID, Mutation{})
+		assert.Nil(t, err)
+		_, err = s.GetTradeByClientID("T-1")
+		assert.Equal(t, ErrTradeNotFound, err)
+		got, err = s.GetTradeByClientID("T-2")
+		assert.Nil(t, err)
+		assert.Equal(t, ret.ID, got.ID)
+	})
+}
+
+// setClock makes s stamp versions with now instead of the wall clock
+func setClock(t *testing.T, s TradeStore, now func() time.Time) {
+	switch st := s.(type) {
+	case *MemoryStore:
+		st.now = now
+	case *FileStore:
+		st.MemoryStore.now = now
+	case *SQLStore:
+		st.now = now
+	default:
+		t.Fatalf("no clock for %T", s)
+	}
+}
+
+func TestStoreRecordsHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		clock := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		setClock(t, s, func() time.Time { return clock })
+		keys, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{Actor: "alice"})
+		assert.Nil(t, err)
+		id := keys[0].TradeID
+
+		clock = clock.Add(time.Hour)
+		_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"1","date":20010101,"quantity":"2","price":"1","ticker":"PRTH"}`), id, Mutation{Actor: "bob", Reason: "fat finger"})
+		assert.Nil(t, err)
+		_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"1","date":20010101,"quantity":"2","price":"1","ticker":"AMZN"}`), "missing", Mutation{Actor: "bob"})
+		assert.Equal(t, ErrTradeNotFound, err, "Failed mutations are not recorded")
+
+		clock = clock.Add(time.Hour)
+		assert.Nil(t, s.DeleteTradeByID(id, Mutation{Actor: "carol", Reason: "cancelled"}))
+
+		history, err := s.TradeHistory(id)
+		assert.Nil(t, err, "History outlives the trade")
+		assert.Equal(t, 3, len(history))
+		assert.Equal(t, []model.Action{model.ActionCreated, model.ActionUpdated, model.ActionDeleted},
+			[]model.Action{history[0].Action, history[1].Action, history[2].Action})
+		for i, v := range history {
+			assert.Equal(t, id, v.TradeID)
+			assert.Equal(t, i+1, v.Version)
+		}
+		assert.Nil(t, history[0].Before)
+		assert.Equal(t, "alice", history[0].Actor)
+		assert.Equal(t, "1", history[1].Before.Quantity.String())
+		assert.Equal(t, "2", history[1].After.Quantity.String())
+		assert.Equal(t, "fat finger", history[1].Reason)
+		assert.True(t, clock.Add(-time.Hour).Equal(history[1].At))
+		assert.Nil(t, history[2].After)
+		assert.Equal(t, "carol", history[2].Actor)
+
+		start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		_, err = s.TradeAsOf(id, start.Add(-time.Second))
+		assert.Equal(t, ErrTradeNotFound, err, "Not booked yet")
+		got, err := s.TradeAsOf(id, start.Add(30*time.Minute))
+		assert.Nil(t, err)
+		assert.Equal(t, "1", got.Trade.Quantity.String())
+		got, err = s.TradeAsOf(id, start.Add(time.Hour))
+		assert.Nil(t, err)
+		assert.Equal(t, "2", got.Trade.Quantity.String())
+		_, err = s.TradeAsOf(id, start.Add(3*time.Hour))
+		assert.Equal(t, ErrTradeNotFound, err, "Deleted by then")
+
+		_, err = s.TradeHistory("missing")
+		assert.Equal(t, ErrTradeNotFound, err)
+	})
+}
+
+func TestSQLStoreHistoryIsImmutable(t *testing.T) {
+	s, err := OpenSQLStore(":memory:")
+	assert.Nil(t, err)
+	defer s.Close()
+	_, err = s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{Actor: "alice"})
+	assert.Nil(t, err)
+
+	_, err = s.db.Exec(`UPDATE trade_versions SET actor = 'mallory'`)
+	assert.NotNil(t, err)
+	_, err = s.db.Exec(`DELETE FROM trade_versions`)
+	assert.NotNil(t, err)
+}
+
+func TestStoreConditionalMutations(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		keys, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{})
+		assert.Nil(t, err)
+		id := keys[0].TradeID
+		got, _ := s.GetTradeByID(id)
+		assert.Equal(t, 1, got.Version)
+
+		stale, current := 0, 1
+		_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"1","date":20010101,"quantity":"2","price":"1","ticker":"PRTH"}`), id, Mutation{IfVersion: &stale})
+		assert.Equal(t, ErrVersionMismatch, err)
+		ret, err := s.UpdateExistingTrade([]byte(`{"client_trade_id":"1","date":20010101,"quantity":"2","price":"1","ticker":"PRTH"}`), id, Mutation{IfVersion: &current})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, ret.Version)
+		got, _ = s.GetTradeByClientID("1")
+		assert.Equal(t, 2, got.Version)
+
+		assert.Equal(t, ErrVersionMismatch, s.DeleteTradeByID(id, Mutation{IfVersion: &current}))
+		history, _ := s.TradeHistory(id)
+		assert.Equal(t, 2, len(history), "Rejected mutations are not recorded")
+		current = 2
+		assert.Nil(t, s.DeleteTradeByID(id, Mutation{IfVersion: &current}))
+	})
+}
+
+func TestStoreInsertEachTrade(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		_, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{})
+		assert.Nil(t, err)
+
+		trades := []model.Trade{fsTrade("AAPL"), fsTrade("PRTH"), fsTrade("MSFT"), fsTrade("AAPL")}
+		res, errs, err := s.InsertEachTrade(trades, Mutation{})
+		assert.Nil(t, err)
+		assert.Equal(t, []error{nil, ErrDuplicateTrade, nil, ErrDuplicateTrade}, errs, "Conflicts with the store and earlier trades of the batch are rejected")
+		for _, i := range []int{0, 2} {
+			got, err := s.GetTradeByID(res[i].TradeID)
+			assert.Nil(t, err)
+			assert.Equal(t, trades[i].Ticker, got.Trade.Ticker)
+		}
+		all, _ := s.GetAllTrades()
+		assert.Equal(t, 3, len(all))
+	})
+}
+
+func TestStoreScopesTradesToOwner(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		alice, bob := ForClient(s, "alice"), ForClient(s, "bob")
+		mine, err := alice.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"a1","date":20010101,"quantity":"1","price":"1","ticker":"PRTH"}]`), Mutation{})
+		assert.Nil(t, err)
+		_, err = bob.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"b1","date":20010101,"quantity":"1","price":"1","ticker":"AMZN"}]`), Mutation{})
+		assert.Nil(t, err)
+		id := mine[0].TradeID
+
+		got, err := alice.GetTradeByID(id)
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", got.Owner)
+		all, err := alice.GetAllTrades()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"PRTH"}, tickers(all))
+		page, err := bob.QueryTrades(TradeQuery{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"AMZN"}, tickers(page.Trades))
+		all, _ = s.GetAllTrades()
+		assert.Equal(t, 2, len(all), "The unscoped store sees every trade")
+
+		_, err = bob.GetTradeByID(id)
+		assert.Equal(t, ErrTradeNotFound, err)
+		_, err = bob.GetTradeByClientID("a1")
+		assert.Equal(t, ErrTradeNotFound, err)
+		_, err = bob.UpdateExistingTrade([]byte(`{"client_trade_id":"a1","date":20010101,"quantity":"9","price":"1","ticker":"PRTH"}`), id, Mutation{})
+		assert.Equal(t, ErrTradeNotFound, err)
+		assert.Equal(t, ErrTradeNotFound, bob.DeleteTradeByID(id, Mutation{}))
+		_, err = bob.TradeHistory(id)
+		assert.Equal(t, ErrTradeNotFound, err)
+
+		updated, err := alice.UpdateExistingTrade([]byte(`{"client_trade_id":"a1","date":20010101,"quantity":"9","price":"1","ticker":"PRTH"}`), id, Mutation{})
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", updated.Owner, "Updates keep the owner")
+		assert.Nil(t, alice.DeleteTradeByID(id, Mutation{}))
+		owner, err := s.TradeOwner(id)
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", owner, "Ownership outlives the trade")
+		_, err = bob.TradeHistory(id)
+		assert.Equal(t, ErrTradeNotFound, err)
+		history, err := alice.TradeHistory(id)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(history))
+	})
+}
+
+func TestStoreAPIKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		issued, err := s.CreateAPIKey("alice", false, "trader", "compliance")
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", issued.ClientID)
+		assert.Equal(t, []string{"trader", "compliance"}, issued.Roles)
+		admin, err := s.CreateAPIKey("ops", true)
+		assert.Nil(t, err)
+
+		got, err := s.Authenticate(issued.Key)
+		assert.Nil(t, err)
+		assert.Equal(t, issued.APIKey, got)
+		_, err = s.Authenticate("tk_wrong")
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		keys, err := s.ListAPIKeys()
+		assert.Nil(t, err)
+		assert.Equal(t, []model.APIKey{issued.APIKey, admin.APIKey}, keys)
+
+		assert.Nil(t, s.RevokeAPIKey(issued.ID))
+		_, err = s.Authenticate(issued.Key)
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, ErrKeyNotFound, s.RevokeAPIKey(issued.ID))
+	})
+}
+
+func TestStoreSeparatesBooks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		acme, globex := s.Book("acme"), s.Book("globex")
+		JSON := []byte(`[{"client_trade_id":"c1","date":20010101,"quantity":"1","price":"1","ticker":"AAPL"}]`)
+		mine, err := acme.AtomicInsertTradesFromJSONArray(JSON, Mutation{Owner: "alice"})
+		assert.Nil(t, err)
+		theirs, err := globex.AtomicInsertTradesFromJSONArray(JSON, Mutation{Owner: "alice"})
+		assert.Nil(t, err, "Tickers and client IDs are only unique within a book")
+		_, err = acme.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+		assert.Equal(t, ErrDuplicateTrade, err)
+		id := mine[0].TradeID
+
+		all, err := acme.GetAllTrades()
+		assert.Nil(t, err)
+		assert.Equal(t, id, all[0].ID)
+		assert.Equal(t, 1, len(all))
+		page, err := globex.QueryTrades(TradeQuery{Ticker: "AAPL"})
+		assert.Nil(t, err)
+		assert.Equal(t, theirs[0].TradeID, page.Trades[0].ID)
+		got, err := globex.GetTradeByClientID("c1")
+		assert.Nil(t, err)
+		assert.Equal(t, theirs[0].TradeID, got.ID)
+		all, _ = s.GetAllTrades()
+		assert.Equal(t, 0, len(all), "The default book holds neither")
+		n, _ := s.CountTrades()
+		assert.Equal(t, 2, n, "Counts cover every book")
+
+		_, err = globex.GetTradeByID(id)
+		assert.Equal(t, ErrTradeNotFound, err)
+		_, err = globex.TradeAsOf(id, time.Now())
+		assert.Equal(t, ErrTradeNotFound, err)
+		_, err = globex.TradeOwner(id)
+		assert.Equal(t, ErrTradeNotFound, err)
+		_, err = globex.UpdateExistingTrade([]byte(`{"client_trade_id":"c2","date":20010101,"quantity":"9","price":"1","ticker":"MSFT"}`), id, Mutation{})
+		assert.Equal(t, ErrTradeNotFound, err)
+		assert.Equal(t, ErrTradeNotFound, globex.DeleteTradeByID(id, Mutation{}))
+		assert.Nil(t, acme.DeleteTradeByID(id, Mutation{}))
+		_, err = globex.TradeHistory(id)
+		assert.Equal(t, ErrTradeNotFound, err, "The history of deleted trades stays in their book")
+		history, err := acme.TradeHistory(id)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(history))
+
+		issued, err := acme.CreateAPIKey("alice", true)
+		assert.Nil(t, err)
+		assert.Equal(t, "acme", issued.Tenant)
+		got2, err := s.Authenticate(issued.Key)
+		assert.Nil(t, err, "Keys authenticate from any book")
+		assert.Equal(t, "acme", got2.Tenant)
+		keys, _ := globex.ListAPIKeys()
+		assert.Equal(t, 0, len(keys))
+		assert.Equal(t, ErrKeyNotFound, globex.RevokeAPIKey(issued.ID))
+		assert.Nil(t, acme.RevokeAPIKey(issued.ID))
+	})
+}
+
+func TestStoreEnforcesQuotas(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s TradeStore) {
+		acme := s.Book("acme")
+		m := Mutation{MaxTrades: 2}
+		_, err := acme.AtomicInsertTradesFromJSONArray([]byte(`[
+			{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"AAPL"},
+			{"client_trade_id":"2","date":20010101,"quantity":"1","price":"1","ticker":"AMZN"},
+			{"client_trade_id":"3","date":20010101,"quantity":"1","price":"1","ticker":"MSFT"}]`), m)
+		assert.Equal(t, ErrQuotaExceeded, err)
+		all, _ := acme.GetAllTrades()
+		assert.Equal(t, 0, len(all), "A batch over quota inserts nothing")
+
+		submitted, errs, err := acme.InsertEachTrade([]model.Trade{fsTrade("AAPL"), fsTrade("AMZN"), fsTrade("MSFT")}, m)
+		assert.Nil(t, err)
+		assert.Equal(t, []error{nil, nil, ErrQuotaExceeded}, errs)
+		_, err = s.Book("globex").AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"1","price":"1","ticker":"AAPL"}]`), m)
+		assert.Nil(t, err, "Quotas count the trades of one book")
+
+		assert.Nil(t, acme.DeleteTradeByID(submitted[0].TradeID, Mutation{}))
+		_, errs, err = acme.InsertEachTrade([]model.Trade{fsTrade("MSFT")}, m)
+		assert.Nil(t, err)
+		assert.Equal(t, []error{nil}, errs, "Deleting a trade frees its place")
+	})
+}
+
+func TestSQLStoreMigratesTradesIntoDefaultBook(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trades.sqlite")
+	old, err := sql.Open("sqlite", "file:"+path)
+	assert.Nil(t, err)
+	_, err = old.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`)
+	assert.Nil(t, err)
+	for v, m := range migrations[:5] {
+		_, err := old.Exec(m)
+		assert.Nil(t, err)
+		_, err = old.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, v+1)
+		assert.Nil(t, err)
+	}
+	_, err = old.Exec(`INSERT INTO trades (id, client_trade_id, date, quantity, price, ticker) VALUES ('t1', 'c1', 20010101, '1', '1', 'AAPL')`)
+	assert.Nil(t, err)
+	_, err = old.Exec(`INSERT INTO api_keys (id, hash, client_id, admin, created_at) VALUES ('k1', 'h1', 'alice', 0, 0)`)
+	assert.Nil(t, err)
+	assert.Nil(t, old.Close())
+
+	s, err := OpenSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	got, err := s.GetTradeByID("t1")
+	assert.Nil(t, err, "Existing trades are in the default book")
+	assert.Equal(t, "AAPL", got.Trade.Ticker)
+	keys, _ := s.ListAPIKeys()
+	assert.Equal(t, "default", keys[0].Tenant)
+	_, err = s.Book("acme").AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"c1","date":20010101,"quantity":"1","price":"1","ticker":"AAPL"}]`), Mutation{})
+	assert.Nil(t, err)
+}
+
+func TestSQLStoreKeepsOnlyKeyHashes(t *testing.T) {
+	s, err := OpenSQLStore(":memory:")
+	assert.Nil(t, err)
+	defer s.Close()
+	issued, err := s.CreateAPIKey("alice", false)
+	assert.Nil(t, err)
+	var hash string
+	assert.Nil(t, s.db.QueryRow(`SELECT hash FROM api_keys`).Scan(&hash))
+	assert.Equal(t, HashAPIKey(issued.Key), hash)
+	assert.NotContains(t, hash, issued.Key)
+}
+
+func TestInstrumentRecordsLatency(t *testing.T) {
+	s := Instrument(NewMemoryStore())
+	inserts, gets := storeLatency.Count("insert_trades"), storeLatency.Count("get_trade_by_id")
+	submitted, err := s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"c1","date":20200101,"quantity":"1","price":"1","ticker":"AAPL"}]`), Mutation{})
+	assert.Nil(t, err)
+	_, err = s.GetTradeByID(submitted[0].TradeID)
+	assert.Nil(t, err)
+	_, err = s.GetTradeByID("missing")
+	assert.Equal(t, ErrTradeNotFound, err, "Errors pass through")
+	n, err := s.CountTrades()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Equal(t, inserts+1, storeLatency.Count("insert_trades"))
+	assert.Equal(t, gets+2, storeLatency.Count("get_trade_by_id"))
+}
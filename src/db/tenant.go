@@ -0,0 +1,41 @@
+package db
+
+// DefaultTenant ...the book of stores opened without naming one, which also
+// holds every trade and API key recorded before there were books
+const DefaultTenant = "default"
+
+// ownership ...the book a trade is in and the client that posted it; both are
+// kept once the trade is deleted. An empty Tenant is the DefaultTenant.
+type ownership struct {
+	Tenant string
+	Owner  string
+}
+
+// bookKey returns the secondary index key of value within tenant's book
+func bookKey(tenant, value string) string {
+	return tenant + "\x00" + value
+}
+
+// Book ...the store of tenant's book; it shares its state, lock and journal with s
+func (s *MemoryStore) Book(tenant string) TradeStore {
+	return &MemoryStore{books: s.books, tenant: tenant}
+}
+
+// tenantOf returns the book trade id is in; callers must hold mu
+func (s *books) tenantOf(id string) string {
+	if t := s.owners[id].Tenant; len(t) > 0 {
+		return t
+	}
+	return DefaultTenant
+}
+
+// inBook reports whether trade id is in s's book; callers must hold mu
+func (s *MemoryStore) inBook(id string) bool {
+	return s.tenantOf(id) == s.tenant
+}
+
+// known reports whether trade id is in s's book, live or deleted; callers must hold mu
+func (s *MemoryStore) known(id string) bool {
+	_, live := s.trades[id]
+	return (live || len(s.history[id]) > 0) && s.inBook(id)
+}
@@ -1,134 +1,555 @@
 package db
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"math"
+	"sync"
+	"time"
 
 	"github.com/clear-street/backend-screening-parthingle/src/model"
 )
 
-// AllTrades is a mock DB as a key-value store
-var AllTrades = map[string]model.Trade{}
+var (
+	// ErrTradeNotFound is returned when no trade has the requested ID
+	ErrTradeNotFound = errors.New("trade not found")
+	// ErrDuplicateTrade is returned when a trade's ticker or client ID is already taken
+	ErrDuplicateTrade = errors.New("contains trade with already existing ticker or client ID")
+	// ErrVersionMismatch is returned when a conditional mutation finds the trade at another version
+	ErrVersionMismatch = errors.New("trade has been modified since the given version")
+	// ErrQuotaExceeded is returned when an insert would take a book past Mutation.MaxTrades
+	ErrQuotaExceeded = errors.New("book holds the maximum number of trades")
+)
+
+// TradeStore ...storage backend for trades used by the HTTP handlers. A
+// store reads and writes a single tenant's book of trades; tickers and client
+// trade IDs are unique within a book, and no method reaches another book.
+type TradeStore interface {
+	KeyStore
+	// Book ...the store of tenant's book, sharing this store's backend
+	Book(tenant string) TradeStore
+	// GetAllTrades ... used by HandleFunc GET /v1/trades
+	GetAllTrades() ([]model.InternalTrade, error)
+	// QueryTrades ...used by HandleFunc GET /v1/trades with filters, sorting and pagination
+	QueryTrades(q TradeQuery) (TradePage, error)
+	// GetTradeByID ...used by HandleFunc GET /v1/trades/{trade_id}
+	GetTradeByID(id string) (model.InternalTrade, error)
+	// GetTradeByClientID ...used by HandleFunc /v1/trades/by-client-id/{client_trade_id}
+	GetTradeByClientID(clientID string) (model.InternalTrade, error)
+	// DeleteTradeByID ...used by HandleFunc DELETE /v1/trades/{trade_id}
+	DeleteTradeByID(id string, m Mutation) error
+	// AtomicInsertTradesFromJSONArray ...used by HandleFunc POST /v1/trades
+	AtomicInsertTradesFromJSONArray(ts []byte, m Mutation) ([]model.TradeSubmitted, error)
+	// InsertEachTrade ...used by HandleFunc POST /v1/trades?atomic=false; inserts
+	// every trade that does not conflict and returns, per trade, its submission
+	// or its error. The error result is for failures of the whole batch.
+	InsertEachTrade(trades []model.Trade, m Mutation) ([]model.TradeSubmitted, []error, error)
+	// UpdateExistingTrade ...used by HandleFunc PUT /v1/trades/{trade_id}
+	UpdateExistingTrade(t []byte, tradeID string, m Mutation) (model.InternalTrade, error)
+	// TradeHistory ...used by HandleFunc GET /v1/trades/{trade_id}/history
+	TradeHistory(id string) ([]model.TradeVersion, error)
+	// TradeAsOf ...used by HandleFunc GET /v1/trades/{trade_id}?as_of=
+	TradeAsOf(id string, at time.Time) (model.InternalTrade, error)
+	// CountTrades ...used by the trades_stored metric; counts the trades of every book
+	CountTrades() (int, error)
+	// TradeOwner ...the client that posted trade id; it is kept once the
+	// trade is deleted, and empty for trades booked before keys were issued
+	TradeOwner(id string) (string, error)
+}
+
+// MemoryStore is a mock DB as an in-memory key-value store.
+// It is safe for concurrent use; every mutation is serialized by mu.
+type MemoryStore struct {
+	*books
+	// tenant is the book this store reads and writes
+	tenant string
+}
+
+// books ...the state shared by the MemoryStores of every tenant's book
+type books struct {
+	mu      sync.RWMutex
+	trades  map[string]model.Trade
+	journal journal
+
+	// Secondary indexes, maintained by apply and keyed by bookKey. Both
+	// fields are unique within a book, so each maps to a single trade ID.
+	byTicker   map[string]string
+	byClientID map[string]string
+	// counts holds the number of trades in each book
+	counts map[string]int
+
+	// aliases maps legacy md5 IDs of migrated trades to their current ID
+	aliases map[string]string
+
+	// history holds every version of every trade, including deleted ones
+	history map[string][]model.TradeVersion
+	// owners maps trade IDs, including those of deleted trades, to their book and owner
+	owners map[string]ownership
+	// keys maps API key hashes to the stored keys
+	keys map[string]storedKey
+	now  func() time.Time
+}
+
+// op is a single idempotent state change; every mutation of a MemoryStore
+// is expressed as a batch of ops passed to commit
+type op struct {
+	Kind  string      `json:"op"`
+	ID    string      `json:"id"`
+	Trade model.Trade `json:"trade"`
+	// Alias is the legacy ID resolved to ID by an opAlias
+	Alias string `json:"alias,omitempty"`
+	// Version is appended to the history of ID by an opVersion
+	Version *model.TradeVersion `json:"version,omitempty"`
+	// Owner and Tenant are recorded as the owner and book of ID by an opOwner
+	Owner  string `json:"owner,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	// Key is stored under ID by an opKey
+	Key *storedKey `json:"key,omitempty"`
+}
+
+const (
+	opPut     = "put"
+	opDelete  = "delete"
+	opAlias   = "alias"
+	opVersion = "version"
+	opOwner   = "owner"
+	opKey     = "key"
+	opRevoke  = "revoke"
+)
+
+// journal is notified of every committed batch of ops, e.g. to persist them
+type journal interface {
+	// record is called with mu held before ops are applied; an error aborts the commit
+	record(ops []op) error
+	// committed is called with mu held after ops are applied
+	committed(s *MemoryStore)
+}
+
+// NewMemoryStore returns an empty MemoryStore of the DefaultTenant's book
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tenant: DefaultTenant, books: &books{
+		trades:     map[string]model.Trade{},
+		byTicker:   map[string]string{},
+		byClientID: map[string]string{},
+		counts:     map[string]int{},
+		aliases:    map[string]string{},
+		history:    map[string][]model.TradeVersion{},
+		owners:     map[string]ownership{},
+		keys:       map[string]storedKey{},
+		now:        time.Now,
+	}}
+}
 
 // GetAllTrades ... used by HandleFunc GET /v1/trades
-func GetAllTrades() ([]model.InternalTrade, error) {
+func (s *MemoryStore) GetAllTrades() ([]model.InternalTrade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	trades := []model.InternalTrade{}
 
-	for k, v := range AllTrades {
-		t := model.InternalTrade{ID: k, Trade: v}
-		trades = append(trades, t)
+	for k := range s.trades {
+		if s.inBook(k) {
+			trades = append(trades, s.internal(k))
+		}
 	}
 
 	return trades, nil
 }
 
+// CountTrades ...used by the trades_stored metric
+func (s *MemoryStore) CountTrades() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.trades), nil
+}
+
+// QueryTrades ...used by HandleFunc GET /v1/trades with filters, sorting and pagination
+func (s *MemoryStore) QueryTrades(q TradeQuery) (TradePage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(q.Ticker) > 0 {
+		trades := []model.InternalTrade{}
+		if id, ok := s.byTicker[bookKey(s.tenant, q.Ticker)]; ok {
+			trades = append(trades, s.internal(id))
+		}
+		return paginate(trades, q)
+	}
+	trades := make([]model.InternalTrade, 0, s.counts[s.tenant])
+	for k := range s.trades {
+		if s.inBook(k) {
+			trades = append(trades, s.internal(k))
+		}
+	}
+
+	return paginate(trades, q)
+}
+
 // GetTradeByID ...used by HandleFunc GET /v1/trades/{trade_id}
-func GetTradeByID(id string) (model.InternalTrade, error) {
-	ret := model.InternalTrade{}
-	if val, ok := AllTrades[id]; ok {
-		ret.Trade = val
-		ret.ID = id
-		return ret, nil
+func (s *MemoryStore) GetTradeByID(id string) (model.InternalTrade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id = s.resolve(id)
+	if _, ok := s.trades[id]; ok && s.inBook(id) {
+		return s.internal(id), nil
+	}
+
+	return model.InternalTrade{}, ErrTradeNotFound
+}
+
+// internal returns the trade stored under id with its current version; callers must hold mu
+func (s *MemoryStore) internal(id string) model.InternalTrade {
+	return model.InternalTrade{ID: id, Trade: s.trades[id], Version: len(s.history[id]), Owner: s.owners[id].Owner}
+}
+
+// TradeOwner ...the client that posted trade id
+func (s *MemoryStore) TradeOwner(id string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id = s.resolve(id)
+	if !s.known(id) {
+		return "", ErrTradeNotFound
 	}
 
-	return ret, errors.New("trade not found")
+	return s.owners[id].Owner, nil
+}
+
+// GetTradeByClientID ...used by HandleFunc /v1/trades/by-client-id/{client_trade_id}
+func (s *MemoryStore) GetTradeByClientID(clientID string) (model.InternalTrade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id, ok := s.byClientID[bookKey(s.tenant, clientID)]; ok {
+		return s.internal(id), nil
+	}
+
+	return model.InternalTrade{}, ErrTradeNotFound
 }
 
 // DeleteTradeByID ...used by HandleFunc DELETE /v1/trades/{trade_id}
-func DeleteTradeByID(id string) error {
-	if _, ok := AllTrades[id]; ok {
-		delete(AllTrades, id)
-		return nil
+func (s *MemoryStore) DeleteTradeByID(id string, m Mutation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id = s.resolve(id)
+	old, ok := s.trades[id]
+	if !ok || !s.inBook(id) {
+		return ErrTradeNotFound
+	}
+	if !m.allows(len(s.history[id])) {
+		return ErrVersionMismatch
+	}
+
+	return s.commit([]op{
+		{Kind: opDelete, ID: id},
+		s.versionOp(id, model.ActionDeleted, &old, nil, m),
+	})
+}
+
+// commit journals ops and then applies them; callers must hold mu
+func (s *MemoryStore) commit(ops []op) error {
+	if s.journal != nil {
+		if err := s.journal.record(ops); err != nil {
+			return err
+		}
+	}
+	s.apply(ops)
+	if s.journal != nil {
+		s.journal.committed(s)
+	}
+
+	return nil
+}
+
+// apply mutates the in-memory state without any checks; callers must hold mu
+func (s *MemoryStore) apply(ops []op) {
+	for _, o := range ops {
+		switch o.Kind {
+		case opPut:
+			s.unindex(o.ID)
+			s.trades[o.ID] = o.Trade
+			s.index(o.ID)
+		case opDelete:
+			s.unindex(o.ID)
+			delete(s.trades, o.ID)
+		case opAlias:
+			s.aliases[o.Alias] = o.ID
+		case opVersion:
+			// Versions are replayed in order; skipping known ones keeps this idempotent
+			if h := s.history[o.ID]; o.Version.Version > len(h) {
+				s.history[o.ID] = append(h, *o.Version)
+			}
+		case opOwner:
+			// Ownership is recorded before the trade is put, but moving an
+			// existing trade between books keeps the indexes right too
+			s.unindex(o.ID)
+			s.owners[o.ID] = ownership{Tenant: o.Tenant, Owner: o.Owner}
+			s.index(o.ID)
+		case opKey:
+			k := *o.Key
+			if len(k.Tenant) == 0 {
+				k.Tenant = DefaultTenant
+			}
+			s.keys[k.Hash] = k
+		case opRevoke:
+			for hash, k := range s.keys {
+				if k.ID == o.ID {
+					delete(s.keys, hash)
+				}
+			}
+		}
 	}
+}
 
-	return errors.New("trade not found")
+// index adds the index entries of the trade stored under id, if any
+func (s *MemoryStore) index(id string) {
+	t, ok := s.trades[id]
+	if !ok {
+		return
+	}
+	tenant := s.tenantOf(id)
+	s.byTicker[bookKey(tenant, t.Ticker)] = id
+	s.byClientID[bookKey(tenant, t.ClientTradeID)] = id
+	s.counts[tenant]++
+}
+
+// unindex drops the index entries of the trade stored under id, if any
+func (s *MemoryStore) unindex(id string) {
+	old, ok := s.trades[id]
+	if !ok {
+		return
+	}
+	tenant := s.tenantOf(id)
+	if ticker := bookKey(tenant, old.Ticker); s.byTicker[ticker] == id {
+		delete(s.byTicker, ticker)
+	}
+	if clientID := bookKey(tenant, old.ClientTradeID); s.byClientID[clientID] == id {
+		delete(s.byClientID, clientID)
+	}
+	s.counts[tenant]--
 }
 
-// GenKey is a deterministic way to generate internal db ID for lookups
-func GenKey(t model.Trade) string {
-	j, _ := json.Marshal(t)
-	hash := md5.Sum(j)
-	s := hex.EncodeToString(hash[:])
+// snapshotOps returns the ops that rebuild the current state from empty; callers must hold mu
+func (s *MemoryStore) snapshotOps() []op {
+	ops := make([]op, 0, len(s.owners)+len(s.trades)+len(s.aliases))
+	// Ownership first, so each trade is indexed in its own book when it is put
+	for id, o := range s.owners {
+		ops = append(ops, op{Kind: opOwner, ID: id, Owner: o.Owner, Tenant: o.Tenant})
+	}
+	for k, v := range s.trades {
+		ops = append(ops, op{Kind: opPut, ID: k, Trade: v})
+	}
+	for legacy, id := range s.aliases {
+		ops = append(ops, op{Kind: opAlias, ID: id, Alias: legacy})
+	}
+	for id, versions := range s.history {
+		for i := range versions {
+			ops = append(ops, op{Kind: opVersion, ID: id, Version: &versions[i]})
+		}
+	}
+	for _, k := range s.keys {
+		k := k
+		ops = append(ops, op{Kind: opKey, ID: k.ID, Key: &k})
+	}
 
-	return s[:int(math.Min(float64(len(s)), 255.9))]
+	return ops
 }
 
-func lookupByTickerAndClientID(t model.Trade) bool {
-	for _, v := range AllTrades {
-		if t.Ticker == v.Ticker {
-			return true
+// resolve maps a legacy ID to the current ID of its trade; other IDs are returned as is.
+// Callers must hold mu.
+func (s *MemoryStore) resolve(id string) string {
+	if _, ok := s.trades[id]; ok {
+		return id
+	}
+	if current, ok := s.aliases[id]; ok {
+		return current
+	}
+
+	return id
+}
+
+// freshID returns a new trade ID not in use by any trade; callers must hold mu
+func (s *MemoryStore) freshID() string {
+	for {
+		id := newTradeID()
+		if _, taken := s.trades[id]; !taken {
+			return id
 		}
-		if t.ClientTradeID == v.ClientTradeID {
-			return true
+	}
+}
+
+// MigrateLegacyIDs re-keys every trade stored under a legacy md5 ID, copies
+// its versions to the new ID and records the old ID as an alias. It returns
+// the number of trades migrated.
+func (s *MemoryStore) MigrateLegacyIDs() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops := []op{}
+	n := 0
+	for old, t := range s.trades {
+		if !isLegacyID(old) {
+			continue
+		}
+		id := s.freshID()
+		o := s.owners[old]
+		ops = append(ops,
+			op{Kind: opDelete, ID: old},
+			op{Kind: opOwner, ID: id, Owner: o.Owner, Tenant: o.Tenant},
+			op{Kind: opPut, ID: id, Trade: t},
+			op{Kind: opAlias, ID: id, Alias: old})
+		for _, v := range s.history[old] {
+			v := v
+			v.TradeID = id
+			ops = append(ops, op{Kind: opVersion, ID: id, Version: &v})
 		}
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	// One commit, so a crash mid-migration leaves either every trade or none re-keyed
+	if err := s.commit(ops); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// lookupByTickerAndClientID reports whether a trade of the book other than
+// exclude shares t's ticker or client ID
+func (s *MemoryStore) lookupByTickerAndClientID(t model.Trade, exclude string) bool {
+	if id, ok := s.byTicker[bookKey(s.tenant, t.Ticker)]; ok && id != exclude {
+		return true
+	}
+	if id, ok := s.byClientID[bookKey(s.tenant, t.ClientTradeID)]; ok && id != exclude {
+		return true
 	}
 
 	return false
 }
 
 // GetTradesFromJSONArraySafe ..used by AtomicInsertTradesFromJSONArray
-func GetTradesFromJSONArraySafe(js []byte) ([]model.Trade, error) {
+func (s *MemoryStore) GetTradesFromJSONArraySafe(js []byte) ([]model.Trade, error) {
 	trades, err := model.FromJSON(js)
 	if err != nil {
 		return trades, err
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return trades, s.checkUnique(trades)
+}
+
+// checkUnique verifies trades against the store and each other; callers must hold mu
+func (s *MemoryStore) checkUnique(trades []model.Trade) error {
+	tickers := make(map[string]bool, len(trades))
+	clientIDs := make(map[string]bool, len(trades))
 	for _, t := range trades {
-		if lookupByTickerAndClientID(t) {
-			return trades, errors.New("contains trade with already existing ticker or client ID")
+		if s.lookupByTickerAndClientID(t, "") {
+			return ErrDuplicateTrade
 		}
-	}
-	// TODO: Use a set() here maybe
-	for i, t := range trades {
-		for j, q := range trades {
-			if i != j && (t.ClientTradeID == q.ClientTradeID || t.Ticker == q.Ticker) {
-				return trades, errors.New("contains trade with already existing ticker or client ID")
-			}
+		if tickers[t.Ticker] || clientIDs[t.ClientTradeID] {
+			return ErrDuplicateTrade
 		}
+		tickers[t.Ticker] = true
+		clientIDs[t.ClientTradeID] = true
 	}
 
-	return trades, nil
+	return nil
 }
 
 // AtomicInsertTradesFromJSONArray ...used by HandleFunc POST /v1/trades
-func AtomicInsertTradesFromJSONArray(ts []byte) ([]model.TradeSubmitted, error) {
+func (s *MemoryStore) AtomicInsertTradesFromJSONArray(ts []byte, m Mutation) ([]model.TradeSubmitted, error) {
 	res := []model.TradeSubmitted{}
-	trades, err := GetTradesFromJSONArraySafe(ts)
+	trades, err := model.FromJSON(ts)
 	if err != nil {
 		return res, err
 	}
-	for _, t := range trades {
-		tradeID := GenKey(t)
-		AllTrades[tradeID] = t
+	// The uniqueness check and the inserts happen under one write lock so
+	// that concurrent batches cannot both pass the check.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkUnique(trades); err != nil {
+		return res, err
+	}
+	if !m.fits(s.counts[s.tenant], len(trades)) {
+		return res, ErrQuotaExceeded
+	}
+	ops := make([]op, 0, 3*len(trades))
+	for i := range trades {
+		t := trades[i]
+		tradeID := s.freshID()
+		ops = append(ops, s.ownerOp(tradeID, m), op{Kind: opPut, ID: tradeID, Trade: t}, s.versionOp(tradeID, model.ActionCreated, nil, &t, m))
 		res = append(res, model.TradeSubmitted{ClientTradeID: t.ClientTradeID, TradeID: tradeID})
 	}
+	if err := s.commit(ops); err != nil {
+		return []model.TradeSubmitted{}, err
+	}
 
 	return res, nil
 }
 
+// InsertEachTrade ...used by HandleFunc POST /v1/trades?atomic=false
+func (s *MemoryStore) InsertEachTrade(trades []model.Trade, m Mutation) ([]model.TradeSubmitted, []error, error) {
+	res := make([]model.TradeSubmitted, len(trades))
+	errs := make([]error, len(trades))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Trades accepted earlier in the batch count towards uniqueness of later ones
+	tickers := map[string]bool{}
+	clientIDs := map[string]bool{}
+	ops := make([]op, 0, 3*len(trades))
+	inserted := 0
+	for i := range trades {
+		t := trades[i]
+		if !m.fits(s.counts[s.tenant], inserted+1) {
+			errs[i] = ErrQuotaExceeded
+			continue
+		}
+		if s.lookupByTickerAndClientID(t, "") || tickers[t.Ticker] || clientIDs[t.ClientTradeID] {
+			errs[i] = ErrDuplicateTrade
+			continue
+		}
+		tickers[t.Ticker] = true
+		clientIDs[t.ClientTradeID] = true
+		tradeID := s.freshID()
+		ops = append(ops, s.ownerOp(tradeID, m), op{Kind: opPut, ID: tradeID, Trade: t}, s.versionOp(tradeID, model.ActionCreated, nil, &t, m))
+		inserted++
+		res[i] = model.TradeSubmitted{ClientTradeID: t.ClientTradeID, TradeID: tradeID}
+	}
+	if len(ops) > 0 {
+		if err := s.commit(ops); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return res, errs, nil
+}
+
 // UpdateExistingTrade ...used by HandleFunc PUT /v1/trades/
-func UpdateExistingTrade(t []byte, tradeID string) (model.InternalTrade, error) {
+func (s *MemoryStore) UpdateExistingTrade(t []byte, tradeID string, m Mutation) (model.InternalTrade, error) {
 	ret := model.InternalTrade{}
-	if _, ok := AllTrades[tradeID]; !ok {
-		return ret, errors.New("trade not found")
-
+	trade, err := model.TradeFromJSON(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tradeID = s.resolve(tradeID)
+	old, ok := s.trades[tradeID]
+	if !ok || !s.inBook(tradeID) {
+		return ret, ErrTradeNotFound
+	}
+	if !m.allows(len(s.history[tradeID])) {
+		return ret, ErrVersionMismatch
 	}
-	trade, err := model.FromJSON(t)
 	if err != nil {
 		return ret, err
 	}
-	temp := AllTrades[tradeID]
-	delete(AllTrades, tradeID)
-	if lookupByTickerAndClientID(trade[0]) {
-		AllTrades[tradeID] = temp
-		return ret, errors.New("contains trade with already existing ticker or client ID")
+	if s.lookupByTickerAndClientID(trade, tradeID) {
+		return ret, ErrDuplicateTrade
+	}
+	// The trade keeps its ID; only its fields change
+	ops := []op{
+		{Kind: opPut, ID: tradeID, Trade: trade},
+		s.versionOp(tradeID, model.ActionUpdated, &old, &trade, m),
+	}
+	if err := s.commit(ops); err != nil {
+		return ret, err
 	}
-	newTradeID := GenKey(trade[0])
-	AllTrades[newTradeID] = trade[0]
-	ret.Trade = trade[0]
-	ret.ID = newTradeID
+	ret = s.internal(tradeID)
 
 	return ret, nil
 }
@@ -8,154 +8,142 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func cleanup() {
-	for k := range AllTrades {
-		delete(AllTrades, k)
-	}
-}
-
 func TestGetAfterInsertSuccess(t *testing.T) {
-	defer cleanup()
+	s := NewMemoryStore()
 	JSON := []byte(`[{"client_trade_id":"123456","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
 
-	key, err := AtomicInsertTradesFromJSONArray(JSON)
+	key, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
 	assert.Nil(t, err, "We shouldn't be getting an error here")
 	assert.Equal(t, key[0].ClientTradeID, "123456")
 
-	v := AllTrades[key[0].TradeID]
-
-	assert.Equal(t, key[0].TradeID, GenKey(v))
+	assert.Len(t, key[0].TradeID, tradeIDLen)
 
-	expectedInternalTrade, _ := GetTradeByID(GenKey(v))
+	expectedInternalTrade, _ := s.GetTradeByID(key[0].TradeID)
 	expectedTradeJSON, _ := expectedInternalTrade.Trade.ToJSON()
 	assert.Equal(t, JSON[1:len(JSON)-1], expectedTradeJSON, "The Trade JSONs should match")
 
-	insertedTrade := AllTrades[GenKey(v)]
+	insertedTrade := s.trades[key[0].TradeID]
 	assert.Equal(t, insertedTrade, expectedInternalTrade.Trade, "The Trade objects should match")
-	assert.True(t, len(GenKey(v)) < 256, "Length of the key should be < 256")
+	assert.True(t, len(key[0].TradeID) < 256, "Length of the key should be < 256")
 }
 
 func TestDeleteTradeByIDSuccess(t *testing.T) {
-	defer cleanup()
+	s := NewMemoryStore()
 
 	JSON := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
 
-	key, err := AtomicInsertTradesFromJSONArray(JSON)
+	key, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
 	assert.Nil(t, err, "We shouldn't be getting an error here")
 	assert.Equal(t, key[0].ClientTradeID, "12345")
-	v := AllTrades[key[0].TradeID]
-	assert.Equal(t, key[0].TradeID, GenKey(v))
+	assert.Len(t, key[0].TradeID, tradeIDLen)
 
-	_, exists := AllTrades[GenKey(v)]
+	_, exists := s.trades[key[0].TradeID]
 	assert.True(t, exists, "This trade should exist in DB")
 
-	err = DeleteTradeByID(GenKey(v))
+	err = s.DeleteTradeByID(key[0].TradeID, Mutation{})
 	assert.Nil(t, err, "We shouldn't be getting an error here")
 
-	_, exists = AllTrades[GenKey(v)]
+	_, exists = s.trades[key[0].TradeID]
 	assert.False(t, exists, "This trade shouldn't exist in DB")
 }
 
 func TestDeleteTradeNonExistentIDFail(t *testing.T) {
-	defer cleanup()
+	s := NewMemoryStore()
 
 	JSON := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
 
-	key, err := AtomicInsertTradesFromJSONArray(JSON)
+	key, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
 	assert.Nil(t, err, "We shouldn't be getting an error here")
 	assert.Equal(t, key[0].ClientTradeID, "12345")
-	v := AllTrades[key[0].TradeID]
-	assert.Equal(t, key[0].TradeID, GenKey(v))
+	assert.Len(t, key[0].TradeID, tradeIDLen)
 
-	_, exists := AllTrades[GenKey(v)]
+	_, exists := s.trades[key[0].TradeID]
 	assert.True(t, exists, "This trade should exist in DB")
 
-	err = DeleteTradeByID("non-existent-key")
+	err = s.DeleteTradeByID("non-existent-key", Mutation{})
 	assert.NotNil(t, err, "We should get a trade not found error here")
 	assert.Equal(t, err.Error(), "trade not found")
 
 }
 
 func TestGetTradeNonExistentIDFail(t *testing.T) {
-	defer cleanup()
+	s := NewMemoryStore()
 	JSON := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
 
-	key, err := AtomicInsertTradesFromJSONArray(JSON)
+	key, err := s.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
 	assert.Nil(t, err, "We shouldn't be getting an error here")
 	assert.Equal(t, key[0].ClientTradeID, "12345")
-	v := AllTrades[key[0].TradeID]
-	assert.Equal(t, key[0].TradeID, GenKey(v))
+	assert.Len(t, key[0].TradeID, tradeIDLen)
 
-	_, exists := AllTrades[GenKey(v)]
+	_, exists := s.trades[key[0].TradeID]
 	assert.True(t, exists)
 
-	_, err = GetTradeByID("non-existent-key")
+	_, err = s.GetTradeByID("non-existent-key")
 	assert.NotNil(t, err, "we should get an error here about a non existent trade")
 	assert.Equal(t, err.Error(), "trade not found")
 }
 
 func TestInsertTradeWithDuplicateTickerFail(t *testing.T) {
-	defer cleanup()
+	s := NewMemoryStore()
 
 	JSON1 := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
 
-	key, err := AtomicInsertTradesFromJSONArray(JSON1)
+	key, err := s.AtomicInsertTradesFromJSONArray(JSON1, Mutation{})
 	assert.Nil(t, err, "We shouldn't be getting an error here")
 	assert.Equal(t, key[0].ClientTradeID, "12345")
-	v := AllTrades[key[0].TradeID]
-	assert.Equal(t, key[0].TradeID, GenKey(v))
+	assert.Len(t, key[0].TradeID, tradeIDLen)
 
 	JSON2 := []byte(`[{"client_trade_id":"23456","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
 
-	key, err = AtomicInsertTradesFromJSONArray(JSON2)
+	key, err = s.AtomicInsertTradesFromJSONArray(JSON2, Mutation{})
 	assert.NotNil(t, err, "We should get an error here about an existing trade with this ticker")
 	assert.Equal(t, err.Error(), "contains trade with already existing ticker or client ID")
 
 	JSON3 := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"},{"client_trade_id":"23456","date":20010102,"quantity":"20","price":"87.1","ticker":"PRTH"},{"client_trade_id":"34567","date":20010102,"quantity":"7","price":"5.4","ticker":"AMZN"}]`)
 
-	key, err = AtomicInsertTradesFromJSONArray(JSON3)
+	key, err = s.AtomicInsertTradesFromJSONArray(JSON3, Mutation{})
 	assert.NotNil(t, err, "We should get an error here about an existing trade with this ticker")
 	assert.Equal(t, err.Error(), "contains trade with already existing ticker or client ID")
 
 }
 
 func TestUpdateExistingTradesFailThenSuccess(t *testing.T) {
-	defer cleanup()
+	s := NewMemoryStore()
 	JSONs := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"},{"client_trade_id":"23456","date":20010102,"quantity":"20","price":"87.1","ticker":"AAPL"},{"client_trade_id":"34567","date":20010102,"quantity":"7","price":"5.4","ticker":"AMZN"}]`)
 
-	_, err := AtomicInsertTradesFromJSONArray(JSONs)
+	_, err := s.AtomicInsertTradesFromJSONArray(JSONs, Mutation{})
 	assert.Nil(t, err, "There should be no errors here")
 
 	newTrade := []byte(`{"client_trade_id":"01234","date":20010102,"quantity":"10","price":"5.67","ticker":"QWER"}`)
 	newTradeWithExistingTicker := []byte(`{"client_trade_id":"23456","date":20010102,"quantity":"10","price":"5.67","ticker":"AAPL"}`)
-	_, err = UpdateExistingTrade(newTrade, "non-existent-trade-id")
+	_, err = s.UpdateExistingTrade(newTrade, "non-existent-trade-id", Mutation{})
 
 	assert.NotNil(t, err, "We should get a trade not found error here")
 	assert.Equal(t, err.Error(), "trade not found")
 
-	key := GenKey(model.Trade{ClientTradeID: "12345", Date: 20010101, Quantity: "10", Price: "5.67", Ticker: "PRTH"})
+	key := s.byClientID[bookKey(DefaultTenant, "12345")]
 
-	_, err = UpdateExistingTrade(newTradeWithExistingTicker, key)
+	_, err = s.UpdateExistingTrade(newTradeWithExistingTicker, key, Mutation{})
 	assert.NotNil(t, err, "We should get a existing ticker error here")
 	assert.Equal(t, err.Error(), "contains trade with already existing ticker or client ID")
 
-	ret, err := UpdateExistingTrade(newTrade, key)
+	ret, err := s.UpdateExistingTrade(newTrade, key, Mutation{})
 	assert.Nil(t, err, "There should be no error here")
 	trade := model.Trade{}
 	err = json.Unmarshal(newTrade, &trade)
 
 	assert.Equal(t, ret.Trade, trade)
-	assert.NotEqual(t, key, ret.ID)
+	assert.Equal(t, key, ret.ID, "Updates should never change a trade's ID")
 }
 
 func TestGetAllTradesHappyPathSuccess(t *testing.T) {
-	defer cleanup()
+	s := NewMemoryStore()
 	JSONs := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"},{"client_trade_id":"23456","date":20010102,"quantity":"20","price":"87.1","ticker":"AAPL"},{"client_trade_id":"34567","date":20010102,"quantity":"7","price":"5.4","ticker":"AMZN"}]`)
 
-	_, err := AtomicInsertTradesFromJSONArray(JSONs)
+	_, err := s.AtomicInsertTradesFromJSONArray(JSONs, Mutation{})
 	assert.Nil(t, err, "There should be no errors here")
 
-	allDbItems, _ := GetAllTrades()
+	allDbItems, _ := s.GetAllTrades()
 	JSONsFromDB, err := json.Marshal(allDbItems)
 	assert.Nil(t, err, "There should be no errors here")
 
@@ -173,5 +161,53 @@ func TestGetAllTradesHappyPathSuccess(t *testing.T) {
 	}
 	assert.Nil(t, err, "There should be no errors here")
 
-	assert.Equal(t, tradesFromJSONsFromDB, tradesFromTest, "These values should be equal")
+	assert.ElementsMatch(t, tradesFromJSONsFromDB, tradesFromTest, "These values should be equal")
+}
+
+func TestMemoryStoresAreIsolated(t *testing.T) {
+	s1 := NewMemoryStore()
+	s2 := NewMemoryStore()
+	JSON := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
+
+	key, err := s1.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+	assert.Nil(t, err, "We shouldn't be getting an error here")
+
+	_, err = s2.GetTradeByID(key[0].TradeID)
+	assert.NotNil(t, err, "A trade inserted in one store should not be visible in another")
+
+	_, err = s2.AtomicInsertTradesFromJSONArray(JSON, Mutation{})
+	assert.Nil(t, err, "Uniqueness should only be checked within a single store")
+}
+
+// assertIndexesConsistent checks the secondary indexes against a full scan
+func assertIndexesConsistent(t *testing.T, s *MemoryStore) {
+	assert.Equal(t, len(s.trades), len(s.byTicker))
+	assert.Equal(t, len(s.trades), len(s.byClientID))
+	for id, trade := range s.trades {
+		assert.Equal(t, id, s.byTicker[bookKey(s.tenantOf(id), trade.Ticker)])
+		assert.Equal(t, id, s.byClientID[bookKey(s.tenantOf(id), trade.ClientTradeID)])
+	}
+}
+
+func TestSecondaryIndexesFollowMutations(t *testing.T) {
+	s := NewMemoryStore()
+	JSONs := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"},{"client_trade_id":"23456","date":20010102,"quantity":"20","price":"87.1","ticker":"AAPL"}]`)
+	keys, err := s.AtomicInsertTradesFromJSONArray(JSONs, Mutation{})
+	assert.Nil(t, err)
+	assertIndexesConsistent(t, s)
+
+	ret, err := s.UpdateExistingTrade([]byte(`{"client_trade_id":"34567","date":20010102,"quantity":"7","price":"5.4","ticker":"AMZN"}`), keys[0].TradeID, Mutation{})
+	assert.Nil(t, err)
+	assertIndexesConsistent(t, s)
+	assert.False(t, s.lookupByTickerAndClientID(model.Trade{Ticker: "PRTH", ClientTradeID: "12345"}, ""), "Old values are free after an update")
+
+	_, err = s.UpdateExistingTrade([]byte(`{"client_trade_id":"34567","date":20010103,"quantity":"7","price":"5.4","ticker":"AMZN"}`), ret.ID, Mutation{})
+	assert.Nil(t, err, "An update may keep the trade's own ticker and client ID")
+	assertIndexesConsistent(t, s)
+
+	assert.Nil(t, s.DeleteTradeByID(keys[1].TradeID, Mutation{}))
+	assertIndexesConsistent(t, s)
+	_, err = s.AtomicInsertTradesFromJSONArray([]byte(`[{"client_trade_id":"23456","date":20010102,"quantity":"20","price":"87.1","ticker":"AAPL"}]`), Mutation{})
+	assert.Nil(t, err, "Deleted values can be reused")
+	assertIndexesConsistent(t, s)
 }
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Records in the write-ahead log and in snapshots share one framing:
+//
+//	| length uint32 | crc32c(payload) uint32 | payload (JSON []op) |
+//
+// Both header fields are little-endian.
+const walHeaderSize = 8
+
+// maxRecordSize guards against allocating absurd buffers for a corrupt length field
+const maxRecordSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord marks a final record that was only partially written
+var errTornRecord = errors.New("torn record at end of log")
+
+func encodeRecord(ops []op) ([]byte, error) {
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[walHeaderSize:], payload)
+
+	return buf, nil
+}
+
+// readRecords calls fn for every intact record in r and returns the offset
+// just past the last one. If the final record is torn (short or failing its
+// checksum with nothing after it) errTornRecord is returned together with
+// the offset at which the log should be truncated. Corruption followed by
+// further data is reported as a hard error.
+func readRecords(r io.Reader, fn func(ops []op) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		n, err := io.ReadFull(br, header)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return offset, errTornRecord
+		}
+		if err != nil {
+			return offset, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if length > maxRecordSize {
+			if _, err := br.Peek(1); err == io.EOF {
+				return offset, errTornRecord
+			}
+			return offset, fmt.Errorf("corrupt record length at offset %d", offset)
+		}
+		payload := make([]byte, length)
+		m, err := io.ReadFull(br, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, errTornRecord
+		}
+		if err != nil {
+			return offset, err
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			if _, err := br.Peek(1); err == io.EOF {
+				return offset, errTornRecord
+			}
+			return offset, fmt.Errorf("checksum mismatch at offset %d", offset)
+		}
+		ops := []op{}
+		if err := json.Unmarshal(payload, &ops); err != nil {
+			return offset, fmt.Errorf("undecodable record at offset %d: %v", offset, err)
+		}
+		if err := fn(ops); err != nil {
+			return offset, err
+		}
+		offset += int64(n + m)
+	}
+}
+
+// writeFileSync atomically replaces path with the given records
+func writeFileSync(path string, records ...[]byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if _, err := f.Write(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
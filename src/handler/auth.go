@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/clear-street/backend-screening-parthingle/src/policy"
+	"github.com/clear-street/backend-screening-parthingle/src/router"
+)
+
+const (
+	// API keys are sent as "Authorization: Bearer <key>"
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+	// adminClientID owns the trades posted with an admin key from the config
+	adminClientID = "admin"
+)
+
+var (
+	errUnauthenticated = errors.New("missing or invalid API key")
+	errForbidden       = errors.New("API key does not permit this operation")
+	errOtherTenant     = fmt.Errorf("%w: the book belongs to another tenant", errForbidden)
+)
+
+// Principal ...the client a request is made on behalf of
+type Principal struct {
+	// ClientID owns the trades the client posts; empty when authentication is disabled
+	ClientID string
+	// Admin principals see and change every client's trades and manage keys
+	Admin bool
+	// Tenant is the only book the client may use; empty for the admin keys
+	// of the Options, which may use every book
+	Tenant string
+	// Roles name the grants of the policy the client has
+	Roles []string
+}
+
+type principalKey struct{}
+
+// anonymous is the principal of every request when authentication is disabled
+var anonymous = Principal{Admin: true}
+
+// PrincipalOf returns the principal r was authenticated as
+func PrincipalOf(r *http.Request) Principal {
+	if p, ok := r.Context().Value(principalKey{}).(Principal); ok {
+		return p
+	}
+	return anonymous
+}
+
+// hashKeys returns the hashes of keys, which are compared instead of the keys
+func hashKeys(keys []string) []string {
+	hashes := make([]string, len(keys))
+	for i, k := range keys {
+		hashes[i] = db.HashAPIKey(k)
+	}
+	return hashes
+}
+
+// authenticate returns the principal holding the API key of r: an admin key
+// from the Options, or a key issued by POST /v1/api-keys
+func (h *Handler) authenticate(r *http.Request) (Principal, error) {
+	header := r.Header.Get(authorizationHeader)
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return Principal{}, errUnauthenticated
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+	if len(key) == 0 {
+		return Principal{}, errUnauthenticated
+	}
+	hash := db.HashAPIKey(key)
+	admin := 0
+	for _, k := range *h.adminKeys.Load() {
+		admin |= subtle.ConstantTimeCompare([]byte(hash), []byte(k))
+	}
+	if admin == 1 {
+		return Principal{ClientID: adminClientID, Admin: true}, nil
+	}
+	stored, err := h.store.Authenticate(key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return Principal{}, errUnauthenticated
+	} else if err != nil {
+		return Principal{}, err
+	}
+	return Principal{ClientID: stored.ClientID, Admin: stored.Admin, Tenant: stored.Tenant, Roles: stored.Roles}, nil
+}
+
+// authenticated serves requests with fn once their API key has been checked
+// and found to permit the book they address, unless authentication is disabled
+func (h *Handler) authenticated(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.requireAuth {
+			fn(w, r)
+			return
+		}
+		p, err := h.authenticate(r)
+		if err != nil {
+			if errors.Is(err, errUnauthenticated) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="trades"`)
+			}
+			writeError(w, r, err)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		if !p.permits(tenant(r)) {
+			writeError(w, r, errOtherTenant)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// trades returns the store as seen by the principal of r: the book r
+// addresses, with every trade if authorize granted r any trade, otherwise
+// only the trades its client posted
+func (h *Handler) trades(r *http.Request) db.TradeStore {
+	book := h.store.Book(tenant(r))
+	if grantOf(r) == policy.Any {
+		return book
+	}
+	return db.ForClient(book, PrincipalOf(r).ClientID)
+}
+
+// APIKeysHandlerFunc ...handles GET and POST /v1/api-keys of a book; admins only
+func (h *Handler) APIKeysHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	if !PrincipalOf(r).Admin {
+		writeError(w, r, errForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		keys, err := h.store.Book(tenant(r)).ListAPIKeys()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writeJSON(w, keys)
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		req, err := model.APIKeyFromJSON(body)
+		if err == nil {
+			err = h.checkRoles(req)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		issued, err := h.store.Book(tenant(r)).CreateAPIKey(req.ClientID, req.Admin, req.Roles...)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		Logger(r).Info("issued API key", "key_id", issued.ID, "tenant", issued.Tenant, "client_id", issued.ClientID, "admin", issued.Admin, "roles", issued.Roles)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, issued)
+	}
+}
+
+// APIKeyHandlerFunc ...handles DELETE /v1/api-keys/{key_id} of a book; admins only
+func (h *Handler) APIKeyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	if !PrincipalOf(r).Admin {
+		writeError(w, r, errForbidden)
+		return
+	}
+	id := router.Param(r, "key_id")
+	if err := h.store.Book(tenant(r)).RevokeAPIKey(id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	Logger(r).Info("revoked API key", "key_id", id, "tenant", tenant(r))
+	w.WriteHeader(http.StatusNoContent)
+}
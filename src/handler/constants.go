@@ -140,3 +140,30 @@ func DuplicateTickerFieldPosts() []byte {
 	  ]`)
 
 }
+
+// GoodV2Posts returns properly formatted v2 json bytearray for 200 response
+func GoodV2Posts() []byte {
+	// 200
+	return []byte(`[
+		{
+		  "client_trade_id": "T-50264430-bc41",
+		  "date": 20200101,
+		  "quantity": "100",
+		  "price": "10.00",
+		  "ticker": "AAPL",
+		  "side": "buy",
+		  "account": "ACC-001",
+		  "currency": "USD"
+		},
+		{
+			"client_trade_id": "Q-50264430-bc41",
+			"date": 20200101,
+			"quantity": "100",
+			"price": "10.00",
+			"ticker": "AMZN",
+			"side": "sell",
+			"account": "ACC-001",
+			"currency": "USD"
+		}
+	  ]`)
+}
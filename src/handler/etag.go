@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+)
+
+// errIfMatchList is returned for If-Match headers listing several ETags; a
+// trade has one current version, so only a single ETag or * is accepted
+var errIfMatchList = fmt.Errorf("%w: If-Match must be * or a single ETag", db.ErrInvalidQuery)
+
+// etag returns the strong entity tag of a trade at version v
+func etag(v int) string {
+	return `"` + strconv.Itoa(v) + `"`
+}
+
+// conditionalMutation is mutation(r) constrained by r's If-Match header.
+// An ETag that is not one of ours can never match, so it pins the mutation
+// to a version no trade has.
+func conditionalMutation(r *http.Request) (db.Mutation, error) {
+	m := mutation(r)
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(header) == 0 || header == "*" {
+		return m, nil
+	}
+	if strings.Contains(header, ",") {
+		return m, errIfMatchList
+	}
+	v := -1
+	if len(header) > 2 && header[0] == '"' && header[len(header)-1] == '"' {
+		if n, err := strconv.Atoi(header[1 : len(header)-1]); err == nil && n >= 0 {
+			v = n
+		}
+	}
+	m.IfVersion = &v
+	return m, nil
+}
+
+// notModified reports whether r's If-None-Match header matches a trade at version v.
+// Per RFC 7232 the comparison is weak, so W/ prefixes are ignored.
+func notModified(r *http.Request, v int) bool {
+	header := r.Header.Get("If-None-Match")
+	if len(header) == 0 {
+		return false
+	}
+	tag := etag(v)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -2,13 +2,18 @@ package handler
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/clear-street/backend-screening-parthingle/src/db"
 	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/clear-street/backend-screening-parthingle/src/policy"
+	"github.com/clear-street/backend-screening-parthingle/src/router"
 )
 
 func writeJSON(w http.ResponseWriter, i interface{}) {
@@ -20,86 +25,507 @@ func writeJSON(w http.ResponseWriter, i interface{}) {
 	w.Write(b)
 }
 
-// TradesHandlerFunc ...handles GET and POST /v1/trades endpoint
-func TradesHandlerFunc(w http.ResponseWriter, r *http.Request) {
+// errorStatus maps an error from model or db to the HTTP status it warrants
+func errorStatus(err error) int {
+	var verr *model.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		if verr.Malformed() {
+			return http.StatusBadRequest
+		}
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, db.ErrTradeNotFound), errors.Is(err, db.ErrKeyNotFound), errors.Is(err, errNoRoute):
+		return http.StatusNotFound
+	case errors.Is(err, errUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, errForbidden), errors.Is(err, db.ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errDraining), errors.Is(err, errStoreUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, db.ErrDuplicateTrade):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errIdempotencyInProgress), errors.Is(err, model.ErrPatchTestFailed):
+		return http.StatusConflict
+	case errors.Is(err, errUnsupportedPatch):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, db.ErrInvalidQuery):
+		return http.StatusBadRequest
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// errorBody returns err as a model.Error, with field-level detail for validation errors
+func errorBody(err error) model.Error {
+	body := model.Error{Message: err.Error()}
+	var verr *model.ValidationError
+	if errors.As(err, &verr) {
+		body.Errors = verr.Errors
+	}
+	return body
+}
+
+// writeError writes err as a model.Error body with the status it warrants.
+// Server errors are logged; client errors only at debug level.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	if status >= http.StatusInternalServerError {
+		Logger(r).Error("request failed", "status", status, "error", err.Error())
+	} else {
+		Logger(r).Debug("request rejected", "status", status, "error", err.Error())
+	}
+	body := errorBody(err)
+	body.RequestID = w.Header().Get(requestIDHeader)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	writeJSON(w, body)
+}
+
+// apiVersion returns the API version addressed by the request path
+func apiVersion(r *http.Request) model.APIVersion {
+	if router.Param(r, "version") == "v2" {
+		return model.V2
+	}
+	return model.V1
+}
+
+func tradesForVersion(trades []model.InternalTrade, v model.APIVersion) []model.InternalTrade {
+	ret := make([]model.InternalTrade, 0, len(trades))
+	for _, t := range trades {
+		ret = append(ret, t.ForVersion(v))
+	}
+	return ret
+}
+
+const (
+	// actorHeader names who is making a change; recorded in the trade's history
+	actorHeader = "X-Actor"
+	// reasonHeader is an optional free-text reason for a change
+	reasonHeader   = "X-Change-Reason"
+	anonymousActor = "anonymous"
+)
+
+// mutation returns who is making the changes requested by r and why. An
+// authenticated client is the actor; X-Actor is only trusted without authentication.
+func mutation(r *http.Request) db.Mutation {
+	p := PrincipalOf(r)
+	m := db.Mutation{Actor: p.ClientID, Reason: r.Header.Get(reasonHeader), Owner: p.ClientID}
+	if len(m.Actor) == 0 {
+		m.Actor = r.Header.Get(actorHeader)
+	}
+	if len(m.Actor) == 0 {
+		m.Actor = anonymousActor
+	}
+	return m
+}
+
+// Handler ...serves the /v1/trades endpoints from a TradeStore
+type Handler struct {
+	store       db.TradeStore
+	idempotency *idempotencyCache
+	router      *router.Router
+	maxBody     atomic.Int64
+	log         *slog.Logger
+	build       model.BuildInfo
+	draining    atomic.Bool
+	requireAuth bool
+	// adminKeys holds the hashes of Options.AdminKeys
+	adminKeys atomic.Pointer[[]string]
+	quotas    atomic.Pointer[quotas]
+	policy    atomic.Pointer[policy.Policy]
+}
+
+// DefaultMaxBodyBytes is the largest request body accepted unless configured otherwise
+const DefaultMaxBodyBytes = 10 << 20
+
+// Options ...configuration for a Handler
+type Options struct {
+	// IdempotencyWindow is how long POST responses are kept for replay to
+	// retries with the same Idempotency-Key; defaults to DefaultIdempotencyWindow
+	IdempotencyWindow time.Duration
+	// IdempotencyMaxEntries caps the responses kept for replay; the oldest are
+	// dropped first. Defaults to DefaultIdempotencyMaxEntries.
+	IdempotencyMaxEntries int
+	// MaxBodyBytes is the largest request body accepted; larger ones get a
+	// 413. Defaults to DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+	// Logger receives the access log and request errors; defaults to slog.Default()
+	Logger *slog.Logger
+	// Build is served by /version
+	Build model.BuildInfo
+	// RequireAuth makes the trade and key endpoints require an API key; it
+	// is only read by NewWithOptions
+	RequireAuth bool
+	// AdminKeys are API keys with every permission in every book, on top of
+	// the admin keys issued by POST /v1/api-keys for a single book
+	AdminKeys []string
+	// MaxTrades caps the trades of each book without a TenantQuotas entry; 0 is unlimited
+	MaxTrades int64
+	// TenantQuotas caps the trades of single books by tenant; 0 is unlimited
+	TenantQuotas map[string]int64
+	// Policy decides what the roles of API keys permit; defaults to policy.Default()
+	Policy *policy.Policy
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.IdempotencyWindow <= 0 {
+		opts.IdempotencyWindow = DefaultIdempotencyWindow
+	}
+	if opts.IdempotencyMaxEntries <= 0 {
+		opts.IdempotencyMaxEntries = DefaultIdempotencyMaxEntries
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if opts.Policy == nil {
+		opts.Policy = policy.Default()
+	}
+	return opts
+}
+
+// New returns a Handler backed by the given TradeStore with default Options
+func New(store db.TradeStore) *Handler {
+	return NewWithOptions(store, Options{})
+}
+
+// NewWithOptions returns a Handler backed by the given TradeStore
+func NewWithOptions(store db.TradeStore, opts Options) *Handler {
+	opts = opts.withDefaults()
+	h := &Handler{store: store, idempotency: newIdempotencyCache(opts.IdempotencyWindow, opts.IdempotencyMaxEntries), router: router.New(), log: opts.Logger, build: opts.Build}
+	if h.log == nil {
+		h.log = slog.Default()
+	}
+	h.maxBody.Store(opts.MaxBodyBytes)
+	h.requireAuth = opts.RequireAuth
+	adminKeys := hashKeys(opts.AdminKeys)
+	h.adminKeys.Store(&adminKeys)
+	h.quotas.Store(&quotas{max: opts.MaxTrades, perTenant: opts.TenantQuotas})
+	h.policy.Store(opts.Policy)
+	h.router.NotFound = http.HandlerFunc(notFound)
+	h.router.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
+
+	// Every trade and key route is served for the book of the API key and,
+	// under tenantPrefix, for the book of a named tenant
+	for _, book := range []string{"/{version:v1|v2}", tenantPrefix} {
+		// by-client-id is registered first so it is not taken for a trade_id
+		trades := book + "/trades"
+		h.router.Handle(trades, h.authenticated(h.TradesHandlerFunc), http.MethodGet, http.MethodPost)
+		for _, trade := range []string{trades + "/by-client-id/{client_trade_id}", trades + "/{trade_id}"} {
+			h.router.Handle(trade, h.authenticated(h.TradeHandlerFunc), http.MethodGet, http.MethodDelete, http.MethodPut, http.MethodPatch)
+			h.router.Handle(trade+"/history", h.authenticated(h.HistoryHandlerFunc), http.MethodGet)
+		}
+	}
+	h.router.Handle("/v1/api-keys", h.authenticated(h.APIKeysHandlerFunc), http.MethodGet, http.MethodPost)
+	h.router.Handle("/v1/api-keys/{key_id}", h.authenticated(h.APIKeyHandlerFunc), http.MethodDelete)
+	h.router.Handle("/v1/tenants/"+tenantParam+"/api-keys", h.authenticated(h.APIKeysHandlerFunc), http.MethodGet, http.MethodPost)
+	h.router.Handle("/v1/tenants/"+tenantParam+"/api-keys/{key_id}", h.authenticated(h.APIKeyHandlerFunc), http.MethodDelete)
+	// Probes and anything added by Handle are served without an API key
+	h.router.Handle("/healthz", h.healthz, http.MethodGet)
+	h.router.Handle("/readyz", h.readyz, http.MethodGet)
+	h.router.Handle("/version", h.version, http.MethodGet)
+	return h
+}
+
+// Handle registers fn for pattern and methods alongside the trade endpoints
+func (h *Handler) Handle(pattern string, fn http.HandlerFunc, methods ...string) {
+	h.router.Handle(pattern, fn, methods...)
+}
+
+// SetOptions applies opts, except RequireAuth, to requests served from now
+// on, e.g. on a config reload
+func (h *Handler) SetOptions(opts Options) {
+	opts = opts.withDefaults()
+	h.idempotency.setLimits(opts.IdempotencyWindow, opts.IdempotencyMaxEntries)
+	h.maxBody.Store(opts.MaxBodyBytes)
+	adminKeys := hashKeys(opts.AdminKeys)
+	h.adminKeys.Store(&adminKeys)
+	h.quotas.Store(&quotas{max: opts.MaxTrades, perTenant: opts.TenantQuotas})
+	h.policy.Store(opts.Policy)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBody.Load())
+	}
+	h.logRequests(w, r, h.router)
+}
+
+var (
+	errNoRoute          = errors.New("no such endpoint")
+	errMethodNotAllowed = errors.New("method not allowed on this endpoint")
+)
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, errNoRoute)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, errMethodNotAllowed)
+}
+
+// TradesHandlerFunc ...handles GET and POST /v1/trades and /v2/trades endpoints
+func (h *Handler) TradesHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	r, err := h.authorize(r, methodActions[r.Method])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	version := apiVersion(r)
 	switch method := r.Method; method {
-	case http.MethodGet:
-		trades, err := db.GetAllTrades()
+	case http.MethodGet, http.MethodHead:
+		q, err := parseTradeQuery(r, version)
+		if err != nil {
+			writeError(w, r, err)
+			break
+		}
+		page, err := h.trades(r).QueryTrades(q)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			e, _ := json.Marshal(model.Error{Message: err.Error()})
-			fmt.Fprint(w, e)
+			writeError(w, r, err)
 			break
 		}
 		w.Header().Add("Content-Type", "application/json; charset=utf-8")
-		writeJSON(w, trades)
+		trades := tradesForVersion(page.Trades, version)
+		if len(page.Next) > 0 {
+			w.Header().Set("Link", "<"+nextLink(r, page.Next)+`>; rel="next"`)
+		}
+		// v1 keeps its bare array body; v2 wraps the page with its cursor
+		if version == model.V1 {
+			writeJSON(w, trades)
+			break
+		}
+		writeJSON(w, model.TradeList{Trades: trades, Next: page.Next})
 		break
+
 	case http.MethodPost:
 		body, err := ioutil.ReadAll(r.Body)
-		submissions, err := db.AtomicInsertTradesFromJSONArray(body)
 		if err != nil {
-			errString := err.Error()
-			if strings.Contains(errString, "bad JSON format") {
-				w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, err)
+			break
+		}
+		h.idempotent(w, r, body, func(w http.ResponseWriter) {
+			h.insertTrades(w, r, body)
+		})
+		break
+	}
+}
 
-			} else if strings.Contains(errString, "bad or missing") {
-				w.WriteHeader(http.StatusUnprocessableEntity)
+// insertTrades ...serves POST /v1/trades and /v2/trades once the body has been read
+func (h *Handler) insertTrades(w http.ResponseWriter, r *http.Request, body []byte) {
+	version := apiVersion(r)
+	atomic, err := atomicParam(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !atomic {
+		h.insertEachTrade(w, r, body)
+		return
+	}
+	if version != model.V1 {
+		_, err = model.FromJSONVersion(body, version)
+	}
+	submissions := []model.TradeSubmitted{}
+	if err == nil {
+		submissions, err = h.trades(r).AtomicInsertTradesFromJSONArray(body, h.insertMutation(r))
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, submissions)
+}
 
-			} else if strings.Contains(errString, "bad") {
-				w.WriteHeader(http.StatusBadRequest)
+// atomicParam reads the atomic query parameter of POST /trades; batches are atomic by default
+func atomicParam(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("atomic")
+	if len(s) == 0 {
+		return true, nil
+	}
+	atomic, err := strconv.ParseBool(s)
+	if err != nil {
+		return true, badParam("atomic")
+	}
+	return atomic, nil
+}
 
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
+// insertEachTrade ...serves POST /v1/trades?atomic=false: every valid,
+// non-conflicting trade is inserted and the 207 Multi-Status body reports
+// the outcome of each trade in submission order
+func (h *Handler) insertEachTrade(w http.ResponseWriter, r *http.Request, body []byte) {
+	trades, parseErrs, err := model.FromJSONEach(body, apiVersion(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	valid := []model.Trade{}
+	// at maps each valid trade back to its index in the submitted array
+	at := []int{}
+	for i, perr := range parseErrs {
+		if perr == nil {
+			valid = append(valid, trades[i])
+			at = append(at, i)
+		}
+	}
+	submitted, storeErrs, err := h.trades(r).InsertEachTrade(valid, h.insertMutation(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-			}
-			writeJSON(w, model.Error{Message: errString})
-			break
+	items := make([]model.BatchItem, len(trades))
+	for i, perr := range parseErrs {
+		if perr != nil {
+			items[i] = batchError(i, perr)
 		}
-		writeJSON(w, submissions)
-		break
 	}
+	for j, i := range at {
+		if storeErrs[j] != nil {
+			items[i] = batchError(i, storeErrs[j])
+			continue
+		}
+		items[i] = model.BatchItem{Index: i, Status: http.StatusOK, Result: &submitted[j]}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	writeJSON(w, items)
+}
+
+func batchError(index int, err error) model.BatchItem {
+	body := errorBody(err)
+	return model.BatchItem{Index: index, Status: errorStatus(err), Error: &body}
+}
+
+// tradeID returns the trade_id addressed by the request path, looking it up
+// for routes that address the trade by its client_trade_id
+func (h *Handler) tradeID(r *http.Request) (string, error) {
+	clientID := router.Param(r, "client_trade_id")
+	if len(clientID) == 0 {
+		return router.Param(r, "trade_id"), nil
+	}
+	trade, err := h.trades(r).GetTradeByClientID(clientID)
+	return trade.ID, err
 }
 
-// TradeHandlerFunc ...handles GET, DELETE, and PUT /v1/trades/ endpoint
-func TradeHandlerFunc(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Path[len("/v1/trades/"):]
+// TradeHandlerFunc ...handles GET, DELETE, PUT and PATCH /v1/trades/{trade_id} and
+// /v1/trades/by-client-id/{client_trade_id}, and their /v2/ equivalents
+func (h *Handler) TradeHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	r, err := h.authorize(r, methodActions[r.Method])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id, err := h.tradeID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	version := apiVersion(r)
 	switch method := r.Method; method {
-	case http.MethodGet:
-		trade, err := db.GetTradeByID(id)
+	case http.MethodGet, http.MethodHead:
+		trade, err := h.tradeAsOf(r, id)
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			writeJSON(w, model.Error{Message: err.Error()})
+			writeError(w, r, err)
+			break
+		}
+		w.Header().Set("ETag", etag(trade.Version))
+		if notModified(r, trade.Version) {
+			w.WriteHeader(http.StatusNotModified)
 			break
 		}
-		writeJSON(w, trade)
+		writeJSON(w, trade.ForVersion(version))
 		break
 
 	case http.MethodDelete:
-		err := db.DeleteTradeByID(id)
+		m, err := conditionalMutation(r)
+		if err == nil {
+			err = h.trades(r).DeleteTradeByID(id, m)
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			writeJSON(w, model.Error{Message: err.Error()})
+			writeError(w, r, err)
 		}
 		break
 
 	case http.MethodPut:
 		body, err := ioutil.ReadAll(r.Body)
-		ret, err := db.UpdateExistingTrade(body, id)
 		if err != nil {
-			switch err.Error() {
-			case "trade not found":
-				w.WriteHeader(http.StatusNotFound)
-				break
-			default:
-				w.WriteHeader(http.StatusInternalServerError)
-				break
+			writeError(w, r, err)
+			return
+		}
+		ret := model.InternalTrade{}
+		if version == model.V1 {
+			ret, err = h.putV1Trade(r, id, body)
+		} else if _, err = model.FromJSONVersion(body, version); err == nil {
+			m := db.Mutation{}
+			if m, err = conditionalMutation(r); err == nil {
+				ret, err = h.trades(r).UpdateExistingTrade(body, id, m)
 			}
-			writeJSON(w, model.Error{Message: err.Error()})
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", etag(ret.Version))
+		writeJSON(w, ret.ForVersion(version))
+		break
+
+	case http.MethodPatch:
+		ret, err := h.patchTrade(r, id)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
-		writeJSON(w, ret)
+		w.Header().Set("ETag", etag(ret.Version))
+		writeJSON(w, ret.ForVersion(version))
 		break
+	}
 
+}
+
+// tradeAsOf returns trade id as it currently is, or as it was at the as_of
+// query parameter (an RFC 3339 timestamp) if one is given
+func (h *Handler) tradeAsOf(r *http.Request, id string) (model.InternalTrade, error) {
+	asOf := r.URL.Query().Get("as_of")
+	if len(asOf) == 0 {
+		return h.trades(r).GetTradeByID(id)
 	}
+	at, err := time.Parse(time.RFC3339Nano, asOf)
+	if err != nil {
+		return model.InternalTrade{}, badParam("as_of")
+	}
+	return h.trades(r).TradeAsOf(id, at)
+}
 
+// HistoryHandlerFunc ...handles GET /v1/trades/{trade_id}/history and
+// /v1/trades/by-client-id/{client_trade_id}/history, and their /v2/ equivalents
+func (h *Handler) HistoryHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	r, err := h.authorize(r, policy.History)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id, err := h.tradeID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	versions, err := h.trades(r).TradeHistory(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	version := apiVersion(r)
+	for i := range versions {
+		versions[i] = versions[i].ForVersion(version)
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	writeJSON(w, versions)
 }
@@ -1,24 +1,34 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/clear-street/backend-screening-parthingle/src/db"
 	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/clear-street/backend-screening-parthingle/src/policy"
 	"github.com/stretchr/testify/assert"
 )
 
-func cleanup() {
-	for k := range db.AllTrades {
-		delete(db.AllTrades, k)
-	}
+func TestMain(m *testing.M) {
+	// Keep the access log of every test request out of the test output
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	os.Exit(m.Run())
 }
+
 func TestTradesHandlerFuncHappyPath(t *testing.T) {
-	defer cleanup()
+	h := New(db.NewMemoryStore())
 
 	// GET /v1/trades
 	reqGET, err := http.NewRequest("GET", "/v1/trades", nil)
@@ -27,9 +37,8 @@ func TestTradesHandlerFuncHappyPath(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(TradesHandlerFunc)
 
-	handler.ServeHTTP(rr, reqGET)
+	h.ServeHTTP(rr, reqGET)
 	status := rr.Code
 	assert.Equal(t, status, http.StatusOK, "Status code for GET /v1/trades should always be 200")
 
@@ -38,39 +47,37 @@ func TestTradesHandlerFuncHappyPath(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	handler.ServeHTTP(rr, reqPOST)
+	h.ServeHTTP(rr, reqPOST)
 	status = rr.Code
 	assert.Equal(t, status, http.StatusOK, "Status code for POST GoodPosts() should be 200 on the first attempt")
 
 }
 
 func TestTradesHandlerFuncBadRequestPostsWrongFormat(t *testing.T) {
-	defer cleanup()
+	h := New(db.NewMemoryStore())
 	// POST /v1/trades GoodPosts()
 
-	handler := http.HandlerFunc(TradesHandlerFunc)
 	rr := httptest.NewRecorder()
 	reqPOST, err := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(BadRequestBadPriceTypePosts())))
 	if err != nil {
 		t.Fatal(err)
 	}
-	handler.ServeHTTP(rr, reqPOST)
+	h.ServeHTTP(rr, reqPOST)
 	status := rr.Code
 	assert.Equal(t, status, http.StatusBadRequest, "Status code for POST BadRequestBadPriceTypePosts should be 400")
 
 }
 
 func TestTradesHandlerFuncPostsMissingRequiredField(t *testing.T) {
-	defer cleanup()
+	h := New(db.NewMemoryStore())
 	// POST /v1/trades MissingRequiredJSONParseErrorPosts()
 
-	handler := http.HandlerFunc(TradesHandlerFunc)
 	rr := httptest.NewRecorder()
 	reqPOST, err := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(MissingRequiredJSONParseErrorPosts())))
 	if err != nil {
 		t.Fatal(err)
 	}
-	handler.ServeHTTP(rr, reqPOST)
+	h.ServeHTTP(rr, reqPOST)
 	status := rr.Code
 	// Bad or missing ticker type
 	assert.Equal(t, status, http.StatusUnprocessableEntity, "Status code for POST MissingRequiredJSONParseErrorPosts should be 422")
@@ -85,43 +92,1008 @@ func getParsedTradeObjects(b []byte) ([]model.TradeSubmitted, error) {
 	return t, nil
 }
 func TestTradeHandlerFuncLookupByIDAfterPostSuccess(t *testing.T) {
-	defer cleanup()
-	handler := http.HandlerFunc(TradesHandlerFunc)
+	h := New(db.NewMemoryStore())
 	rr := httptest.NewRecorder()
 	reqPOST, err := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
 	if err != nil {
 		t.Fatal(err)
 	}
-	handler.ServeHTTP(rr, reqPOST)
+	h.ServeHTTP(rr, reqPOST)
 	status := rr.Code
 	assert.Equal(t, status, http.StatusOK, "Should be a successful POST")
 
 	trades, err := getParsedTradeObjects(rr.Body.Bytes())
 	reqGET, err := http.NewRequest("GET", "/v1/trades/"+trades[0].TradeID, nil)
 	assert.Nil(t, err)
-	handler.ServeHTTP(rr, reqGET)
+	h.ServeHTTP(rr, reqGET)
 	status = rr.Code
 	assert.Equal(t, status, http.StatusOK)
 
 }
 
 func TestTradeHandlerFuncDeleteByIDAfterPostSuccess(t *testing.T) {
-	defer cleanup()
-	handler := http.HandlerFunc(TradesHandlerFunc)
+	h := New(db.NewMemoryStore())
 	rr := httptest.NewRecorder()
 	reqPOST, err := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
 	if err != nil {
 		t.Fatal(err)
 	}
-	handler.ServeHTTP(rr, reqPOST)
+	h.ServeHTTP(rr, reqPOST)
 	status := rr.Code
 	assert.Equal(t, status, http.StatusOK, "Should be a successful POST")
 
 	trades, err := getParsedTradeObjects(rr.Body.Bytes())
 	reqGET, err := http.NewRequest("DELETE", "/v1/trades/"+trades[0].TradeID, nil)
 	assert.Nil(t, err)
-	handler.ServeHTTP(rr, reqGET)
+	h.ServeHTTP(rr, reqGET)
 	status = rr.Code
 	assert.Equal(t, status, http.StatusOK)
 
 }
+
+type failingStore struct {
+	db.TradeStore
+}
+
+func (s failingStore) Book(string) db.TradeStore { return s }
+
+func (failingStore) QueryTrades(q db.TradeQuery) (db.TradePage, error) {
+	return db.TradePage{}, errors.New("store unavailable")
+}
+
+func TestTradesHandlerFuncStoreErrorIs500(t *testing.T) {
+	h := New(failingStore{})
+	rr := httptest.NewRecorder()
+	reqGET, err := http.NewRequest("GET", "/v1/trades", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestV2TradesRequireSideAccountCurrency(t *testing.T) {
+	h := New(db.NewMemoryStore())
+
+	rr := httptest.NewRecorder()
+	reqPOST, err := http.NewRequest("POST", "/v2/trades", strings.NewReader(string(GoodPosts())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(rr, reqPOST)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, "v1 bodies are missing v2 fields")
+
+	rr = httptest.NewRecorder()
+	reqPOST, err = http.NewRequest("POST", "/v2/trades", strings.NewReader(string(GoodV2Posts())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(rr, reqPOST)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	trades, err := getParsedTradeObjects(rr.Body.Bytes())
+	assert.Nil(t, err)
+
+	rr = httptest.NewRecorder()
+	reqGET, _ := http.NewRequest("GET", "/v2/trades/"+trades[0].TradeID, nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"side":"buy"`)
+
+	rr = httptest.NewRecorder()
+	reqGET, _ = http.NewRequest("GET", "/v1/trades/"+trades[0].TradeID, nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), `"side"`, "v1 representations omit v2 fields")
+}
+
+func TestV1PutKeepsV2Fields(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := serve("POST", "/v2/trades", `[{"client_trade_id":"c1","date":20200101,"quantity":"1","price":"1","ticker":"AAPL","side":"sell","account":"A1","currency":"EUR"}]`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	trades, err := getParsedTradeObjects(rr.Body.Bytes())
+	assert.Nil(t, err)
+	id := trades[0].TradeID
+	read := func() model.Trade {
+		it := model.InternalTrade{}
+		assert.Nil(t, json.Unmarshal(serve("GET", "/v2/trades/"+id, "").Body.Bytes(), &it))
+		return it.Trade
+	}
+
+	rr = serve("PUT", "/v1/trades/"+id, `{"client_trade_id":"c1","date":20200101,"quantity":"2","price":"1","ticker":"AAPL"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), `"side"`)
+	got := read()
+	assert.Equal(t, "2", got.Quantity.String())
+	assert.Equal(t, model.SideSell, got.Side, "v1 clients cannot send back fields they never see")
+	assert.Equal(t, "A1", got.Account)
+	assert.Equal(t, "EUR", got.Currency)
+
+	assert.Equal(t, http.StatusOK, serve("PUT", "/v1/trades/"+id, `{"client_trade_id":"c1","date":20200101,"quantity":"2","price":"1","ticker":"AAPL","currency":"USD"}`).Code)
+	got = read()
+	assert.Equal(t, "USD", got.Currency, "Fields that are sent replace the stored ones")
+	assert.Equal(t, model.SideSell, got.Side)
+	assert.Equal(t, http.StatusUnprocessableEntity, serve("PUT", "/v1/trades/"+id, `{"client_trade_id":"c1","date":20200101,"quantity":"2","price":"1","ticker":"AAPL","side":"hold"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/v1/trades/unknown", `{"client_trade_id":"c1","date":20200101,"quantity":"2","price":"1","ticker":"AAPL"}`).Code)
+}
+
+func TestTradesHandlerFuncErrorBodyListsFieldErrors(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	rr := httptest.NewRecorder()
+	reqPOST, err := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(MissingRequiredJSONParseErrorPosts())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(rr, reqPOST)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	body := model.Error{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, []model.FieldError{{Index: 2, Pointer: "/2/ticker", Code: model.CodeMissing, Message: "bad or missing ticker format"}}, body.Errors)
+}
+
+func TestTradesHandlerFuncDuplicateIsConflict(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	for i, want := range []int{http.StatusOK, http.StatusConflict} {
+		rr := httptest.NewRecorder()
+		reqPOST, err := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.ServeHTTP(rr, reqPOST)
+		assert.Equal(t, want, rr.Code, "attempt %d", i)
+	}
+}
+
+func TestTradeHandlerFuncPutErrors(t *testing.T) {
+	h := New(db.NewMemoryStore())
+
+	rr := httptest.NewRecorder()
+	reqPUT, _ := http.NewRequest("PUT", "/v1/trades/missing", strings.NewReader(`{"client_trade_id":"1","date":20010101,"quantity":"10","price":"5.67","ticker":"A"}`))
+	h.ServeHTTP(rr, reqPUT)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	reqDELETE, _ := http.NewRequest("DELETE", "/v1/trades/missing", nil)
+	h.ServeHTTP(rr, reqDELETE)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestTradesHandlerFuncPagination(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	rr := httptest.NewRecorder()
+	reqPOST, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
+	h.ServeHTTP(rr, reqPOST)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// v1 keeps a bare array and advertises the next page in a Link header
+	rr = httptest.NewRecorder()
+	reqGET, _ := http.NewRequest("GET", "/v1/trades?sort=-ticker&limit=2", nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	trades := []model.InternalTrade{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &trades))
+	assert.Equal(t, "PRTH", trades[0].Trade.Ticker)
+	assert.Equal(t, "AMZN", trades[1].Trade.Ticker)
+	assert.Contains(t, rr.Header().Get("Link"), `rel="next"`)
+
+	// v2 wraps the page together with its cursor
+	rr = httptest.NewRecorder()
+	reqGET, _ = http.NewRequest("GET", "/v2/trades?sort=-ticker&limit=2", nil)
+	h.ServeHTTP(rr, reqGET)
+	list := model.TradeList{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	assert.Equal(t, 2, len(list.Trades))
+
+	rr = httptest.NewRecorder()
+	reqGET, _ = http.NewRequest("GET", "/v2/trades?sort=-ticker&limit=2&cursor="+list.Next, nil)
+	h.ServeHTTP(rr, reqGET)
+	list = model.TradeList{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	assert.Equal(t, 1, len(list.Trades))
+	assert.Equal(t, "AAPL", list.Trades[0].Trade.Ticker)
+	assert.Equal(t, "", list.Next)
+
+	for _, bad := range []string{"limit=0", "limit=abc", "sort=colour", "price_min=1e3", "date_from=x", "cursor=zzz"} {
+		rr = httptest.NewRecorder()
+		reqGET, _ = http.NewRequest("GET", "/v1/trades?"+bad, nil)
+		h.ServeHTTP(rr, reqGET)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, bad)
+	}
+}
+
+func TestTradeHandlerFuncByClientID(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	rr := httptest.NewRecorder()
+	reqPOST, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
+	h.ServeHTTP(rr, reqPOST)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	reqGET, _ := http.NewRequest("GET", "/v1/trades/by-client-id/T-50264430-bc41", nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"ticker":"AAPL"`)
+
+	rr = httptest.NewRecorder()
+	reqPUT, _ := http.NewRequest("PUT", "/v1/trades/by-client-id/T-50264430-bc41", strings.NewReader(`{"client_trade_id":"T-50264430-bc41","date":20200102,"quantity":"50","price":"10.00","ticker":"AAPL"}`))
+	h.ServeHTTP(rr, reqPUT)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"quantity":"50"`)
+
+	rr = httptest.NewRecorder()
+	reqPUT, _ = http.NewRequest("PUT", "/v1/trades/by-client-id/T-50264430-bc41", strings.NewReader(`{"client_trade_id":"X","date":20200102,"quantity":"50","price":"10.00","ticker":"AMZN"}`))
+	h.ServeHTTP(rr, reqPUT)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = httptest.NewRecorder()
+	reqDELETE, _ := http.NewRequest("DELETE", "/v1/trades/by-client-id/T-50264430-bc41", nil)
+	h.ServeHTTP(rr, reqDELETE)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		rr = httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/v1/trades/by-client-id/T-50264430-bc41", strings.NewReader(`{}`))
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code, method)
+	}
+}
+
+func TestTradeHandlerFuncHistoryAndAsOf(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	rr := httptest.NewRecorder()
+	reqPOST, _ := http.NewRequest("POST", "/v2/trades", strings.NewReader(string(GoodV2Posts())))
+	reqPOST.Header.Set("X-Actor", "alice")
+	h.ServeHTTP(rr, reqPOST)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	submitted := []model.TradeSubmitted{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &submitted))
+	id := submitted[0].TradeID
+
+	rr = httptest.NewRecorder()
+	reqDELETE, _ := http.NewRequest("DELETE", "/v1/trades/"+id, nil)
+	reqDELETE.Header.Set("X-Change-Reason", "cancelled by client")
+	h.ServeHTTP(rr, reqDELETE)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	reqGET, _ := http.NewRequest("GET", "/v2/trades/"+id+"/history", nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	history := []model.TradeVersion{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &history))
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, "alice", history[0].Actor)
+	assert.Equal(t, "anonymous", history[1].Actor)
+	assert.Equal(t, "cancelled by client", history[1].Reason)
+	assert.NotEmpty(t, history[1].Before.Side, "v2 history keeps v2 fields")
+
+	rr = httptest.NewRecorder()
+	reqGET, _ = http.NewRequest("GET", "/v1/trades/"+id+"/history", nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.NotContains(t, rr.Body.String(), `"side"`, "v1 history must not leak v2 fields")
+
+	rr = httptest.NewRecorder()
+	reqGET, _ = http.NewRequest("GET", "/v1/trades/"+id+"?as_of="+history[0].At.Format(time.RFC3339Nano), nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusOK, rr.Code, "The trade existed at the time of its first version")
+
+	rr = httptest.NewRecorder()
+	reqGET, _ = http.NewRequest("GET", "/v1/trades/"+id, nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	reqGET, _ = http.NewRequest("GET", "/v1/trades/"+id+"?as_of=yesterday", nil)
+	h.ServeHTTP(rr, reqGET)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestTradeHandlerFuncETags(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	rr := httptest.NewRecorder()
+	reqPOST, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
+	h.ServeHTTP(rr, reqPOST)
+	submitted := []model.TradeSubmitted{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &submitted))
+	url := "/v1/trades/" + submitted[0].TradeID
+	do := func(method, ifMatch, ifNoneMatch string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(`{"client_trade_id":"T-50264430-bc41","date":20200102,"quantity":"50","price":"10.00","ticker":"AAPL"}`))
+		if len(ifMatch) > 0 {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		if len(ifNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr = do("GET", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"1"`, rr.Header().Get("ETag"))
+
+	rr = do("GET", "", `"0", W/"1"`)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, 0, rr.Body.Len())
+	assert.Equal(t, http.StatusOK, do("GET", "", `"2"`).Code)
+
+	assert.Equal(t, http.StatusPreconditionFailed, do("PUT", `"0"`, "").Code)
+	assert.Equal(t, http.StatusPreconditionFailed, do("PUT", `W/"1"`, "").Code, "Weak ETags never match If-Match")
+	assert.Equal(t, http.StatusBadRequest, do("PUT", `"0", "1"`, "").Code)
+	rr = do("PUT", `"1"`, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusPreconditionFailed, do("DELETE", `"1"`, "").Code)
+	assert.Equal(t, http.StatusOK, do("DELETE", `"2"`, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", `"2"`, "").Code)
+}
+
+func TestTradesHandlerFuncIdempotencyKey(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.idempotency.now = func() time.Time { return clock }
+	post := func(key, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := post("k1", string(GoodPosts()))
+	assert.Equal(t, http.StatusOK, first.Code)
+	retry := post("k1", string(GoodPosts()))
+	assert.Equal(t, http.StatusOK, retry.Code, "A retry replays the original success instead of a conflict")
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "", first.Header().Get("Idempotent-Replayed"))
+
+	rr := post("k1", `[{"client_trade_id":"other","date":20200101,"quantity":"1","price":"1","ticker":"MSFT"}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, "A key cannot be reused for a different body")
+
+	rr = post("k2", string(GoodPosts()))
+	assert.Equal(t, http.StatusConflict, rr.Code, "Without the original key the duplicate is a conflict")
+	assert.Equal(t, http.StatusConflict, post("k2", string(GoodPosts())).Code, "Error responses are replayed too")
+
+	clock = clock.Add(DefaultIdempotencyWindow + time.Second)
+	assert.Equal(t, http.StatusConflict, post("k1", string(GoodPosts())).Code, "Keys expire after the window")
+	assert.Equal(t, http.StatusBadRequest, post(strings.Repeat("k", 256), string(GoodPosts())).Code)
+}
+
+func TestTradesHandlerFuncIdempotencyKeyEviction(t *testing.T) {
+	h := NewWithOptions(db.NewMemoryStore(), Options{IdempotencyMaxEntries: 2})
+	post := func(key, ticker string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(`[{"client_trade_id":"`+ticker+`","date":20200101,"quantity":"1","price":"1","ticker":"`+ticker+`"}]`))
+		req.Header.Set("Idempotency-Key", key)
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	for i, key := range []string{"k1", "k2", "k3"} {
+		assert.Equal(t, http.StatusOK, post(key, "T"+strconv.Itoa(i)).Code)
+	}
+	assert.Equal(t, 2, len(h.idempotency.entries), "The cache never holds more than its maximum")
+	assert.Equal(t, "true", post("k3", "T2").Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, http.StatusConflict, post("k1", "T0").Code, "The oldest response is evicted first")
+}
+
+// flakyStore fails the first insert with a server error
+type flakyStore struct {
+	db.TradeStore
+	failed *bool
+}
+
+func (s flakyStore) Book(string) db.TradeStore { return s }
+
+func (s flakyStore) AtomicInsertTradesFromJSONArray(ts []byte, m db.Mutation) ([]model.TradeSubmitted, error) {
+	if !*s.failed {
+		*s.failed = true
+		return nil, errors.New("store unavailable")
+	}
+	return s.TradeStore.AtomicInsertTradesFromJSONArray(ts, m)
+}
+
+func TestTradesHandlerFuncIdempotencyKeySkipsServerErrors(t *testing.T) {
+	h := New(flakyStore{db.NewMemoryStore(), new(bool)})
+	for _, want := range []int{http.StatusInternalServerError, http.StatusOK} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
+		req.Header.Set("Idempotency-Key", "k1")
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, want, rr.Code, "A server error must not be replayed to the retry")
+	}
+}
+
+func TestTradesHandlerFuncPartialBatch(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(`[{"client_trade_id":"1","date":20200101,"quantity":"1","price":"1","ticker":"AAPL"}]`))
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	body := `[{"client_trade_id":"2","date":20200101,"quantity":"1","price":"1","ticker":"MSFT"},` +
+		`{"client_trade_id":"3","date":20200101,"quantity":"1","price":"1","ticker":"AAPL"},` +
+		`{"client_trade_id":"4","date":2,"quantity":"1","price":"1","ticker":"AMZN"},` +
+		`{"client_trade_id":"5","date":20200101,"quantity":1,"price":"1","ticker":"TSLA"},` +
+		`{"client_trade_id":"6","date":20200101,"quantity":"1","price":"1","ticker":"IBM"}]`
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/trades?atomic=false", strings.NewReader(body))
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusMultiStatus, rr.Code)
+	items := []model.BatchItem{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &items))
+	assert.Equal(t, 5, len(items))
+	statuses := []int{}
+	for i, item := range items {
+		assert.Equal(t, i, item.Index)
+		statuses = append(statuses, item.Status)
+	}
+	assert.Equal(t, []int{200, 409, 422, 400, 200}, statuses)
+	assert.Equal(t, "2", items[0].Result.ClientTradeID)
+	assert.Nil(t, items[0].Error)
+	assert.Equal(t, "/2/date", items[2].Error.Errors[0].Pointer)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/trades", nil)
+	h.ServeHTTP(rr, req)
+	all := []model.InternalTrade{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &all))
+	assert.Equal(t, 3, len(all), "Valid trades are inserted despite the failures")
+
+	for _, q := range []string{"?atomic=false", "?atomic=maybe"} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/v1/trades"+q, strings.NewReader(`not json`))
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, q)
+	}
+}
+
+func TestTradeHandlerFuncPatch(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	rr := httptest.NewRecorder()
+	reqPOST, _ := http.NewRequest("POST", "/v2/trades", strings.NewReader(string(GoodV2Posts())))
+	h.ServeHTTP(rr, reqPOST)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	submitted := []model.TradeSubmitted{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &submitted))
+	patch := func(url, contentType, ifMatch, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", url, strings.NewReader(body))
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if len(ifMatch) > 0 {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	url := "/v2/trades/" + submitted[0].TradeID
+
+	rr = patch(url, "application/merge-patch+json", "", `{"quantity":"75"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+	ret := model.InternalTrade{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &ret))
+	assert.Equal(t, "75", ret.Trade.Quantity.String())
+	assert.Equal(t, submitted[0].ClientTradeID, ret.Trade.ClientTradeID, "Untouched fields are kept")
+	assert.NotEmpty(t, ret.Trade.Side)
+
+	rr = patch("/v1/trades/"+submitted[0].TradeID, "", "", `{"price":"9.99"}`)
+	assert.Equal(t, http.StatusOK, rr.Code, "A v1 patch keeps the v2 fields it cannot see")
+	got, _ := h.store.GetTradeByID(submitted[0].TradeID)
+	assert.Equal(t, "9.99", got.Trade.Price.String())
+	assert.NotEmpty(t, got.Trade.Side)
+
+	rr = patch(url, "application/json-patch+json", `"3"`, `[{"op":"test","path":"/quantity","value":"75"},{"op":"replace","path":"/quantity","value":"80"}]`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusPreconditionFailed, patch(url, "", `"3"`, `{"quantity":"1"}`).Code)
+	assert.Equal(t, http.StatusConflict, patch(url, "application/json-patch+json", "", `[{"op":"test","path":"/quantity","value":"75"}]`).Code)
+
+	assert.Equal(t, http.StatusConflict, patch(url, "", "", `{"ticker":"AMZN"}`).Code, "The merged trade is checked for uniqueness")
+	assert.Equal(t, http.StatusUnprocessableEntity, patch(url, "", "", `{"price":"cheap"}`).Code, "The merged trade is validated")
+	assert.Equal(t, http.StatusUnprocessableEntity, patch(url, "", "", `{"side":null}`).Code, "v2 fields stay required in v2")
+	assert.Equal(t, http.StatusBadRequest, patch(url, "", "", `{"quantity":`).Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, patch(url, "text/plain", "", `{}`).Code)
+	assert.Equal(t, http.StatusNotFound, patch("/v2/trades/missing", "", "", `{}`).Code)
+}
+
+func TestHandlerRouting(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(string(GoodPosts())))
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := serve("POST", "/v1/trades/")
+	assert.Equal(t, http.StatusOK, rr.Code, "A trailing slash addresses the same endpoint")
+	submitted := []model.TradeSubmitted{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &submitted))
+
+	rr = serve("DELETE", "/v1/trades")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS, POST", rr.Header().Get("Allow"))
+	body := model.Error{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.NotEmpty(t, body.Message)
+
+	rr = serve("POST", "/v1/trades/"+submitted[0].TradeID+"/history")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", rr.Header().Get("Allow"))
+
+	rr = serve("OPTIONS", "/v2/trades/by-client-id/"+submitted[0].ClientTradeID)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS, PATCH, PUT", rr.Header().Get("Allow"))
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/v1/trades/"+submitted[0].TradeID+"/").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/v1/trades/by-client-id/"+submitted[0].ClientTradeID+"/history").Code)
+	for _, url := range []string{"/v1/trades/a/b", "/v3/trades", "/v1/orders", "/"} {
+		rr = serve("GET", url)
+		assert.Equal(t, http.StatusNotFound, rr.Code, url)
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body), url)
+	}
+}
+
+func TestHandlerMaxBodyBytes(t *testing.T) {
+	h := NewWithOptions(db.NewMemoryStore(), Options{MaxBodyBytes: 16})
+	post := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := post()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	body := model.Error{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	for _, path := range []string{"/v1/trades/x", "/v2/trades/x"} {
+		rr = httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, strings.NewReader(`{"client_trade_id":"c1","date":20200101,"quantity":"1","price":"1","ticker":"AAPL"}`))
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, path)
+	}
+
+	h.SetOptions(Options{})
+	assert.Equal(t, http.StatusOK, post().Code, "Options can be changed while serving")
+}
+
+func TestHandlerLogsRequests(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	h := NewWithOptions(&failingStore{db.NewMemoryStore()}, Options{Logger: log})
+	serve := func(method, url, requestID string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, nil)
+		if len(requestID) > 0 {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	lines := func() []map[string]interface{} {
+		ret := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			m := map[string]interface{}{}
+			assert.Nil(t, json.Unmarshal([]byte(line), &m), line)
+			ret = append(ret, m)
+		}
+		buf.Reset()
+		return ret
+	}
+
+	rr := serve("GET", "/v1/trades", "client-id-1")
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, "client-id-1", rr.Header().Get("X-Request-ID"), "A client's request ID is propagated")
+	body := model.Error{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "client-id-1", body.RequestID)
+	logged := lines()
+	assert.Equal(t, 2, len(logged))
+	assert.Equal(t, "ERROR", logged[0]["level"])
+	assert.Equal(t, "client-id-1", logged[0]["request_id"], "Every line carries the request ID")
+	assert.NotEmpty(t, logged[0]["error"])
+	access := logged[1]
+	assert.Equal(t, "request", access["msg"])
+	assert.Equal(t, "client-id-1", access["request_id"])
+	assert.Equal(t, "GET", access["method"])
+	assert.Equal(t, "/v1/trades", access["path"])
+	assert.Equal(t, float64(500), access["status"])
+	assert.Equal(t, float64(rr.Body.Len()), access["bytes"])
+	assert.Contains(t, access, "duration_ms")
+
+	for _, id := range []string{"", "has space", strings.Repeat("x", 129)} {
+		rr = serve("GET", "/v1/nowhere", id)
+		generated := rr.Header().Get("X-Request-ID")
+		assert.Equal(t, 32, len(generated), "An ID is generated if none is usable: %q", id)
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		assert.Equal(t, generated, body.RequestID)
+		logged = lines()
+		assert.Equal(t, "DEBUG", logged[0]["level"], "Client errors are logged at debug")
+		assert.Equal(t, generated, logged[len(logged)-1]["request_id"])
+	}
+}
+
+func TestHandlerCountsRequestsByRoute(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	serve := func(method, url string) {
+		req, _ := http.NewRequest(method, url, nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	const trades, trade = "/{version:v1|v2}/trades", "/{version:v1|v2}/trades/{trade_id}"
+	listed, missing, unmatched, other := requestsServed.Value(trades, "GET", "200"), requestsServed.Value(trade, "GET", "404"),
+		requestsServed.Value(unmatchedRoute, "GET", "404"), requestsServed.Value(trades, "OTHER", "405")
+	observed := requestLatency.Count(trades, "GET")
+
+	serve("GET", "/v1/trades")
+	serve("GET", "/v2/trades/")
+	serve("GET", "/v1/trades/nope")
+	serve("GET", "/v1/whatever/you/like")
+	serve("BREW", "/v1/trades")
+
+	assert.Equal(t, listed+2, requestsServed.Value(trades, "GET", "200"), "Requests are counted by route, not path")
+	assert.Equal(t, missing+1, requestsServed.Value(trade, "GET", "404"))
+	assert.Equal(t, unmatched+1, requestsServed.Value(unmatchedRoute, "GET", "404"))
+	assert.Equal(t, other+1, requestsServed.Value(trades, "OTHER", "405"))
+	assert.Equal(t, observed+2, requestLatency.Count(trades, "GET"))
+}
+
+type unavailableStore struct {
+	db.TradeStore
+}
+
+func (unavailableStore) CountTrades() (int, error) {
+	return 0, errors.New("database is locked")
+}
+
+func TestHandlerProbes(t *testing.T) {
+	build := model.BuildInfo{Commit: "abc123", BuildTime: "2024-01-02T03:04:05Z", GoVersion: "go1.21"}
+	h := NewWithOptions(db.NewMemoryStore(), Options{Build: build})
+	get := func(h *Handler, url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, get(h, "/healthz").Code)
+	assert.Equal(t, http.StatusOK, get(h, "/readyz").Code)
+	rr := get(h, "/version")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	got := model.BuildInfo{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal(t, build, got)
+
+	h.Drain()
+	assert.Equal(t, http.StatusServiceUnavailable, get(h, "/readyz").Code, "A draining server is not ready")
+	assert.Equal(t, http.StatusOK, get(h, "/healthz").Code, "but is still alive")
+
+	h = New(&unavailableStore{db.NewMemoryStore()})
+	rr = get(h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	body := model.Error{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Contains(t, body.Message, "database is locked")
+}
+
+func TestHandlerAuthenticatesAndScopesTrades(t *testing.T) {
+	h := NewWithOptions(db.NewMemoryStore(), Options{RequireAuth: true, AdminKeys: []string{"root-key"}})
+	serve := func(method, url, key, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if len(key) > 0 {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("GET", "/v1/trades", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Bearer realm="trades"`, rr.Header().Get("WWW-Authenticate"))
+	body := model.Error{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "missing or invalid API key", body.Message)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/v1/trades", "wrong", "").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/healthz", "", "").Code, "Probes need no key")
+
+	issue := func(client string) string {
+		rr := serve("POST", "/v1/api-keys", "root-key", `{"client_id":"`+client+`"}`)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		issued := model.IssuedAPIKey{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &issued))
+		assert.Equal(t, client, issued.ClientID)
+		return issued.Key
+	}
+	alice, bob := issue("alice"), issue("bob")
+	assert.Equal(t, http.StatusForbidden, serve("POST", "/v1/api-keys", alice, `{"client_id":"mallory","admin":true}`).Code, "Only admins issue keys")
+	assert.Equal(t, http.StatusUnprocessableEntity, serve("POST", "/v1/api-keys", "root-key", `{}`).Code)
+
+	rr = serve("POST", "/v1/trades", alice, `[{"client_trade_id":"a1","date":20200101,"quantity":"1","price":"1","ticker":"AAPL"}]`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	submitted := []model.TradeSubmitted{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &submitted))
+	id := submitted[0].TradeID
+	assert.Equal(t, http.StatusOK, serve("POST", "/v1/trades", bob, `[{"client_trade_id":"b1","date":20200101,"quantity":"1","price":"1","ticker":"AMZN"}]`).Code)
+
+	list := func(key string) []string {
+		trades := []model.InternalTrade{}
+		assert.Nil(t, json.Unmarshal(serve("GET", "/v1/trades", key, "").Body.Bytes(), &trades))
+		owners := []string{}
+		for _, tr := range trades {
+			owners = append(owners, tr.Owner)
+		}
+		return owners
+	}
+	assert.Equal(t, []string{"alice"}, list(alice))
+	assert.Equal(t, []string{"bob"}, list(bob))
+	assert.ElementsMatch(t, []string{"alice", "bob"}, list("root-key"), "Admins see every trade")
+
+	update := `{"client_trade_id":"a1","date":20200101,"quantity":"2","price":"1","ticker":"AAPL"}`
+	for _, rr := range []*httptest.ResponseRecorder{
+		serve("GET", "/v1/trades/"+id, bob, ""),
+		serve("GET", "/v1/trades/by-client-id/a1", bob, ""),
+		serve("GET", "/v1/trades/"+id+"/history", bob, ""),
+		serve("PUT", "/v1/trades/"+id, bob, update),
+	} {
+		assert.Equal(t, http.StatusNotFound, rr.Code, "Other clients' trades do not exist")
+	}
+	assert.Equal(t, http.StatusForbidden, serve("DELETE", "/v1/trades/"+id, alice, "").Code, "Deleting needs a role")
+	assert.Equal(t, http.StatusOK, serve("PUT", "/v1/trades/"+id, alice, update).Code)
+	history := []model.TradeVersion{}
+	assert.Nil(t, json.Unmarshal(serve("GET", "/v1/trades/"+id+"/history", "root-key", "").Body.Bytes(), &history))
+	assert.Equal(t, "alice", history[1].Actor, "The authenticated client is the actor")
+	assert.Equal(t, http.StatusOK, serve("DELETE", "/v1/trades/"+id, "root-key", "").Code)
+
+	keys := []model.APIKey{}
+	assert.Nil(t, json.Unmarshal(serve("GET", "/v1/api-keys", "root-key", "").Body.Bytes(), &keys))
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/v1/api-keys/"+keys[1].ID, "root-key", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/v1/trades", bob, "").Code, "Revoked keys are rejected")
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/v1/api-keys/"+keys[1].ID, "root-key", "").Code)
+
+	h.SetOptions(Options{AdminKeys: []string{"new-root-key"}})
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/v1/trades", "root-key", "").Code, "Admin keys are reloaded")
+	assert.Equal(t, http.StatusOK, serve("GET", "/v1/trades", "new-root-key", "").Code)
+}
+
+func TestHandlerIsolatesTenants(t *testing.T) {
+	h := NewWithOptions(db.NewMemoryStore(), Options{RequireAuth: true, AdminKeys: []string{"root-key"}, TenantQuotas: map[string]int64{"globex": 1}})
+	serve := func(method, url, key, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		if method == "POST" && strings.HasSuffix(url, "/trades") {
+			req.Header.Set("Idempotency-Key", "same-key")
+		}
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	issue := func(tenant string) model.IssuedAPIKey {
+		rr := serve("POST", "/v1/tenants/"+tenant+"/api-keys", "root-key", `{"client_id":"ops","admin":true}`)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		issued := model.IssuedAPIKey{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &issued))
+		assert.Equal(t, tenant, issued.Tenant)
+		return issued
+	}
+	acme, globex := issue("acme"), issue("globex")
+
+	// Both books take the same trade, with the same client ID and Idempotency-Key
+	post := `[{"client_trade_id":"c1","date":20200101,"quantity":"1","price":"1","ticker":"AAPL"}]`
+	submitted := map[string]string{}
+	for _, k := range []model.IssuedAPIKey{acme, globex} {
+		rr := serve("POST", "/v1/trades", k.Key, post)
+		assert.Equal(t, http.StatusOK, rr.Code, "Tickers are unique within a book")
+		s := []model.TradeSubmitted{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &s))
+		submitted[k.Tenant] = s[0].TradeID
+	}
+	id := submitted["acme"]
+	assert.NotEqual(t, id, submitted["globex"], "Idempotent responses are not replayed across books")
+
+	update := `{"client_trade_id":"c1","date":20200101,"quantity":"2","price":"1","ticker":"AAPL","side":"buy","account":"A1","currency":"USD"}`
+	asOf := "?as_of=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	for _, prefix := range []string{"/v1", "/v2", "/v1/tenants/globex", "/v2/tenants/globex"} {
+		for _, path := range []string{"/trades/" + id, "/trades/" + id + asOf} {
+			assert.Equal(t, http.StatusNotFound, serve("GET", prefix+path, globex.Key, "").Code, prefix+path)
+		}
+		for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+			assert.Equal(t, http.StatusNotFound, serve(method, prefix+"/trades/"+id, globex.Key, update).Code, method+" "+prefix)
+		}
+		assert.Equal(t, http.StatusNotFound, serve("GET", prefix+"/trades/"+id+"/history", globex.Key, "").Code, prefix)
+		// by-client-id finds globex's own trade, never acme's
+		rr := serve("GET", prefix+"/trades/by-client-id/c1", globex.Key, "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotContains(t, rr.Body.String(), id, prefix)
+		rr = serve("GET", prefix+"/trades/by-client-id/c1/history", globex.Key, "")
+		assert.NotContains(t, rr.Body.String(), id, prefix)
+		rr = serve("GET", prefix+"/trades", globex.Key, "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotContains(t, rr.Body.String(), id, prefix)
+	}
+	for _, path := range []string{"/v1/tenants/acme/trades", "/v1/tenants/acme/trades/" + id, "/v1/tenants/acme/trades/" + id + "/history", "/v1/tenants/acme/api-keys"} {
+		rr := serve("GET", path, globex.Key, "")
+		assert.Equal(t, http.StatusForbidden, rr.Code, "Keys only open the book of their tenant: "+path)
+		body := model.Error{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		assert.Contains(t, body.Message, "another tenant")
+	}
+	assert.Equal(t, http.StatusForbidden, serve("DELETE", "/v1/tenants/acme/api-keys/"+acme.ID, globex.Key, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/v1/api-keys/"+acme.ID, globex.Key, "").Code, "Keys of other books do not exist")
+	keys := []model.APIKey{}
+	assert.Nil(t, json.Unmarshal(serve("GET", "/v1/api-keys", globex.Key, "").Body.Bytes(), &keys))
+	assert.Equal(t, []model.APIKey{globex.APIKey}, keys)
+
+	// Configured admin keys reach every book; without a tenant they use the default one
+	trades := []model.InternalTrade{}
+	assert.Nil(t, json.Unmarshal(serve("GET", "/v1/tenants/acme/trades", "root-key", "").Body.Bytes(), &trades))
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, id, trades[0].ID)
+	assert.Equal(t, "[]", serve("GET", "/v1/trades", "root-key", "").Body.String())
+
+	rr := serve("POST", "/v1/trades?atomic=false", globex.Key, `[{"client_trade_id":"c2","date":20200101,"quantity":"1","price":"1","ticker":"MSFT"}]`)
+	assert.Equal(t, http.StatusMultiStatus, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":403`, "The globex book is full")
+	assert.Contains(t, rr.Body.String(), db.ErrQuotaExceeded.Error())
+	assert.Equal(t, http.StatusForbidden, serve("POST", "/v1/trades?atomic=true", globex.Key, `[{"client_trade_id":"c3","date":20200101,"quantity":"1","price":"1","ticker":"IBM"}]`).Code)
+	assert.Equal(t, http.StatusOK, serve("POST", "/v1/tenants/acme/trades", "root-key", `[{"client_trade_id":"c2","date":20200101,"quantity":"1","price":"1","ticker":"MSFT"}]`).Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/v1/tenants/Not_A_Tenant/trades", "root-key", "").Code)
+}
+
+// countingStore counts the books opened on it
+type countingStore struct {
+	*db.MemoryStore
+	books *int
+}
+
+func (s countingStore) Book(tenant string) db.TradeStore {
+	*s.books++
+	return s.MemoryStore.Book(tenant)
+}
+
+func TestHandlerAuthorizesRoles(t *testing.T) {
+	pol, err := policy.Load("../policy.yaml")
+	assert.Nil(t, err)
+	books := 0
+	h := NewWithOptions(countingStore{db.NewMemoryStore(), &books}, Options{RequireAuth: true, AdminKeys: []string{"root-key"}, Policy: pol})
+	serve := func(method, url, key, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	issue := func(client string, roles ...string) string {
+		b, _ := json.Marshal(model.NewAPIKey{ClientID: client, Roles: roles})
+		rr := serve("POST", "/v1/api-keys", "root-key", string(b))
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		issued := model.IssuedAPIKey{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &issued))
+		assert.Equal(t, roles, issued.Roles)
+		return issued.Key
+	}
+	rr := serve("POST", "/v1/api-keys", "root-key", `{"client_id":"eve","roles":["trader","auditor"]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, "Roles must be defined by the policy")
+	assert.Contains(t, rr.Body.String(), `"/roles/1"`)
+	alice, bob := issue("alice", "trader"), issue("bob", "trader")
+	office, compliance, supervisor, none := issue("office", "middle_office"), issue("compliance", "compliance"), issue("supervisor", "supervisor"), issue("none")
+
+	post := func(key, clientTradeID string) *httptest.ResponseRecorder {
+		return serve("POST", "/v1/trades", key, `[{"client_trade_id":"`+clientTradeID+`","date":20200101,"quantity":"1","price":"1","ticker":"`+clientTradeID+`"}]`)
+	}
+	rr = post(alice, "A")
+	assert.Equal(t, http.StatusOK, rr.Code, "Traders post trades")
+	submitted := []model.TradeSubmitted{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &submitted))
+	id := submitted[0].TradeID
+	assert.Equal(t, http.StatusOK, post(bob, "B").Code)
+	update := func(quantity string) string {
+		return `{"client_trade_id":"A","date":20200101,"quantity":"` + quantity + `","price":"1","ticker":"A"}`
+	}
+
+	allowed := []struct {
+		key, method, path, body string
+	}{
+		{alice, "GET", "/v1/trades/" + id, ""},
+		{alice, "HEAD", "/v1/trades", ""},
+		{alice, "HEAD", "/v1/trades/" + id, ""},
+		{alice, "GET", "/v1/trades/" + id + "/history", ""},
+		{alice, "PUT", "/v1/trades/" + id, update("2")},
+		{office, "GET", "/v1/trades/" + id, ""},
+		{office, "PUT", "/v1/trades/" + id, update("3")},
+		{office, "PATCH", "/v1/trades/" + id, `{"quantity":"4"}`},
+		{compliance, "GET", "/v1/trades/" + id, ""},
+		{compliance, "GET", "/v1/trades/" + id + "/history", ""},
+		{compliance, "GET", "/v1/trades/by-client-id/A/history", ""},
+		{supervisor, "GET", "/v1/trades/" + id + "/history", ""},
+	}
+	for _, c := range allowed {
+		assert.Equal(t, http.StatusOK, serve(c.method, c.path, c.key, c.body).Code, c.method+" "+c.path)
+	}
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/v1/trades/"+id, bob, update("5")).Code, "Traders only see their own trades")
+	list := func(key string) int {
+		trades := []model.InternalTrade{}
+		assert.Nil(t, json.Unmarshal(serve("GET", "/v1/trades", key, "").Body.Bytes(), &trades))
+		return len(trades)
+	}
+	assert.Equal(t, 1, list(alice))
+	assert.Equal(t, 2, list(compliance), "Compliance reads every trade")
+
+	denied := []struct {
+		key, method, path, body string
+	}{
+		{alice, "DELETE", "/v1/trades/" + id, ""},
+		{office, "POST", "/v1/trades", `[]`},
+		{office, "DELETE", "/v1/trades/" + id, ""},
+		{compliance, "PUT", "/v1/trades/" + id, update("6")},
+		{compliance, "PATCH", "/v2/trades/" + id, `{"quantity":"6"}`},
+		{compliance, "DELETE", "/v1/trades/" + id, ""},
+		{supervisor, "POST", "/v1/trades", `[]`},
+		{supervisor, "PUT", "/v1/trades/" + id, update("6")},
+		{none, "GET", "/v1/trades", ""},
+		{none, "GET", "/v1/trades/" + id + "/history", ""},
+	}
+	for _, c := range denied {
+		books = 0
+		rr := serve(c.method, c.path, c.key, c.body)
+		assert.Equal(t, http.StatusForbidden, rr.Code, c.method+" "+c.path)
+		body := model.Error{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		assert.Contains(t, body.Message, "not granted", c.method+" "+c.path)
+		assert.Equal(t, 0, books, "Denied requests never reach the store: "+c.method+" "+c.path)
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("HEAD", "/v1/trades", none, "").Code)
+	assert.Equal(t, http.StatusOK, serve("DELETE", "/v1/trades/"+id, supervisor, "").Code, "Only supervisors delete")
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/v1/trades/"+id, compliance, "").Code)
+
+	req, _ := http.NewRequest("TRACE", "/v1/trades", nil)
+	_, err = h.authorize(req, methodActions[req.Method])
+	assert.True(t, errors.Is(err, errMethodNotAllowed), "Methods without an action are never granted")
+
+	h.SetOptions(Options{AdminKeys: []string{"root-key"}, Policy: policy.Default()})
+	assert.Equal(t, http.StatusOK, serve("GET", "/v1/trades", none, "").Code, "SetOptions swaps the policy; the default grants keys without roles their own trades")
+}
+
+func TestHandlerServesHeadLikeGet(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/trades", strings.NewReader(string(GoodPosts())))
+	h.ServeHTTP(rr, req)
+	trades, err := getParsedTradeObjects(rr.Body.Bytes())
+	assert.Nil(t, err)
+
+	do := func(method, path string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	for _, path := range []string{"/v1/trades", "/v2/trades/" + trades[0].TradeID, "/v1/trades/by-client-id/T-50264430-bc41", "/v1/trades/unknown", "/v1/trades/by-client-id/unknown"} {
+		get, getBody := do("GET", path)
+		head, headBody := do("HEAD", path)
+		assert.Equal(t, get.StatusCode, head.StatusCode, path)
+		for _, name := range []string{"ETag", "Content-Type", "Content-Length"} {
+			assert.Equal(t, get.Header.Get(name), head.Header.Get(name), name+" of "+path)
+		}
+		assert.NotEmpty(t, getBody, path)
+		assert.Empty(t, headBody, path)
+	}
+	resp, _ := do("HEAD", "/v1/trades/unknown")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "HEAD on a missing trade is a 404")
+	resp, _ = do("HEAD", "/v1/trades/"+trades[0].TradeID)
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+}
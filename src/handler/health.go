@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+var (
+	errDraining         = errors.New("server is shutting down")
+	errStoreUnavailable = errors.New("trade store unavailable")
+)
+
+// Drain marks the handler as shutting down, so that /readyz fails and load
+// balancers stop sending it requests while in-flight ones finish
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// healthz ...handles GET /healthz; the process is alive if it can answer
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writeJSON(w, model.Health{Status: "ok"})
+}
+
+// readyz ...handles GET /readyz; the server is ready once its store is open,
+// which for the file store includes replaying its log, until it starts
+// draining. The store is asked for its trade count to prove it still answers.
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		writeError(w, r, errDraining)
+		return
+	}
+	if _, err := h.store.CountTrades(); err != nil {
+		writeError(w, r, fmt.Errorf("%w: %s", errStoreUnavailable, err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writeJSON(w, model.Health{Status: "ready"})
+}
+
+// version ...handles GET /version
+func (h *Handler) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writeJSON(w, h.build)
+}
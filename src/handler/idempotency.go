@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// replayedHeader marks a response served from the idempotency cache
+	replayedHeader    = "Idempotent-Replayed"
+	maxIdempotencyKey = 255
+	// DefaultIdempotencyWindow is how long a response is kept for replay unless configured otherwise
+	DefaultIdempotencyWindow = 24 * time.Hour
+	// DefaultIdempotencyMaxEntries is how many responses are kept for replay unless configured otherwise
+	DefaultIdempotencyMaxEntries = 10000
+)
+
+var (
+	errIdempotencyKeyReused  = errors.New("Idempotency-Key was already used with a different request")
+	errIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still being processed")
+	errIdempotencyKeyTooLong = fmt.Errorf("%w: Idempotency-Key longer than %d characters", db.ErrInvalidQuery, maxIdempotencyKey)
+)
+
+// storedResponse ...response to the first request made with an idempotency key
+type storedResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyCache ...responses by idempotency key, kept for window after they
+// are written, or until maxEntries newer ones have pushed them out
+type idempotencyCache struct {
+	mu         sync.Mutex
+	window     time.Duration
+	maxEntries int
+	now        func() time.Time
+	entries    map[string]*storedResponse
+	// order holds keys by expiry so expired entries can be dropped from the front
+	order []string
+}
+
+func newIdempotencyCache(window time.Duration, maxEntries int) *idempotencyCache {
+	return &idempotencyCache{window: window, maxEntries: maxEntries, now: time.Now, entries: map[string]*storedResponse{}}
+}
+
+// setLimits changes how long and how many responses are kept from now on
+func (c *idempotencyCache) setLimits(window time.Duration, maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window = window
+	c.maxEntries = maxEntries
+}
+
+// expire drops entries whose window has passed; callers must hold mu
+func (c *idempotencyCache) expire() {
+	now := c.now()
+	for len(c.order) > 0 {
+		e, ok := c.entries[c.order[0]]
+		if ok && (!e.done || now.Before(e.expires)) {
+			return
+		}
+		if ok {
+			delete(c.entries, c.order[0])
+		}
+		c.order = c.order[1:]
+	}
+}
+
+// evict drops the oldest stored responses until there is room for another
+// entry; callers must hold mu. Requests still in progress are never evicted,
+// so there may be more of them than maxEntries, but only as many as are
+// being served at once.
+func (c *idempotencyCache) evict() {
+	for len(c.entries) >= c.maxEntries && len(c.order) > 0 {
+		if e, ok := c.entries[c.order[0]]; ok && e.done {
+			delete(c.entries, c.order[0])
+		}
+		c.order = c.order[1:]
+	}
+}
+
+// begin claims key for a request with the given fingerprint. It returns the
+// stored response if the request was already served, or nil if the caller
+// should serve it and then call finish or abandon.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (*storedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire()
+	e, ok := c.entries[key]
+	if ok && e.done && !c.now().Before(e.expires) {
+		// Left behind by expire when the window has been shortened
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.evict()
+		c.entries[key] = &storedResponse{fingerprint: fingerprint}
+		return nil, nil
+	}
+	if e.fingerprint != fingerprint {
+		return nil, errIdempotencyKeyReused
+	}
+	if !e.done {
+		return nil, errIdempotencyInProgress
+	}
+	return e, nil
+}
+
+// finish stores the response to the request that claimed key
+func (c *idempotencyCache) finish(key string, rec *recorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	e.done = true
+	e.status = rec.status
+	e.header = rec.Header().Clone()
+	e.body = rec.body.Bytes()
+	e.expires = c.now().Add(c.window)
+	c.order = append(c.order, key)
+}
+
+// abandon releases key so the request can be retried, e.g. after a server error
+func (c *idempotencyCache) abandon(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// recorder ...ResponseWriter that keeps a copy of what is written
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent serves r with serve at most once per Idempotency-Key; retries
+// with the same key and body get the original response replayed byte for
+// byte. Server errors are not stored, so the request can be retried.
+func (h *Handler) idempotent(w http.ResponseWriter, r *http.Request, body []byte, serve func(w http.ResponseWriter)) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) == 0 {
+		serve(w)
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		writeError(w, r, errIdempotencyKeyTooLong)
+		return
+	}
+	// Keys are scoped to the client, its book and the endpoint, so the same
+	// key on /v1 and /v2, or sent by two clients, are distinct
+	scoped := tenant(r) + "\x00" + PrincipalOf(r).ClientID + "\x00" + r.Method + " " + r.URL.Path + "\x00" + key
+	prior, err := h.idempotency.begin(scoped, sha256.Sum256(append([]byte(r.URL.RawQuery+"\x00"), body...)))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if prior != nil {
+		id := w.Header().Get(requestIDHeader)
+		for k, v := range prior.header {
+			w.Header()[k] = append([]string(nil), v...)
+		}
+		// The replayed body keeps the original request's ID, but the header names this one
+		w.Header().Set(requestIDHeader, id)
+		w.Header().Set(replayedHeader, "true")
+		w.WriteHeader(prior.status)
+		w.Write(prior.body)
+		return
+	}
+	rec := &recorder{ResponseWriter: w}
+	serve(rec)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= http.StatusInternalServerError {
+		h.idempotency.abandon(scoped)
+		return
+	}
+	h.idempotency.finish(scoped, rec)
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// requestIDHeader carries the ID of a request; a client-supplied ID is
+	// kept, otherwise one is generated. It is echoed on the response.
+	requestIDHeader = "X-Request-ID"
+	maxRequestID    = 128
+)
+
+type loggerKey struct{}
+
+// Logger returns the logger of the request r, which tags every line with its request ID
+func Logger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// requestID returns the client-supplied ID of r if it is usable, or a new one
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	usable := len(id) > 0 && len(id) <= maxRequestID
+	for i := 0; usable && i < len(id); i++ {
+		// Visible ASCII only, so IDs cannot forge log lines or headers
+		usable = id[i] > ' ' && id[i] <= '~'
+	}
+	if usable {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder ...ResponseWriter noting the status and size of the response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// logRequests serves r with next, tagging it with a request ID, and writes
+// an access log line and records its metrics once it has been served
+func (h *Handler) logRequests(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	start := time.Now()
+	id := requestID(r)
+	w.Header().Set(requestIDHeader, id)
+	log := h.log.With("request_id", id)
+	rec := &statusRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), loggerKey{}, log)))
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	elapsed := time.Since(start)
+	h.observeRequest(r, rec.status, elapsed)
+	log.Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", rec.status,
+		"bytes", rec.bytes,
+		"duration_ms", float64(elapsed.Microseconds())/1000,
+	)
+}
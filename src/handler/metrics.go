@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/clear-street/backend-screening-parthingle/src/metrics"
+)
+
+var (
+	requestsServed = metrics.NewCounter("http_requests_total",
+		"HTTP requests served, by route, method and status code.", "route", "method", "code")
+	requestLatency = metrics.NewHistogram("http_request_duration_seconds",
+		"Latency of HTTP requests, by route and method.", metrics.DefaultBuckets, "route", "method")
+)
+
+// unmatchedRoute labels requests for paths that match no route, so that
+// arbitrary paths cannot create unbounded series
+const unmatchedRoute = "unmatched"
+
+// observeRequest records a request to r that was answered with status after taking d
+func (h *Handler) observeRequest(r *http.Request, status int, d time.Duration) {
+	route := h.router.Pattern(r)
+	if len(route) == 0 {
+		route = unmatchedRoute
+	}
+	method := r.Method
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "OTHER"
+	}
+	requestsServed.Inc(route, method, strconv.Itoa(status))
+	requestLatency.Observe(d.Seconds(), route, method)
+}
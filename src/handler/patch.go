@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+	// patchAttempts bounds how often an unconditional PATCH is re-applied
+	// when another writer changes the trade between read and update
+	patchAttempts = 5
+)
+
+var errUnsupportedPatch = errors.New("PATCH needs Content-Type " + mergePatchType + " or " + jsonPatchType)
+
+// patcher returns how to apply a PATCH body of the request's content type.
+// Plain JSON is taken to be a merge patch.
+func patcher(r *http.Request) (func(doc, patch []byte) ([]byte, error), error) {
+	ct := r.Header.Get("Content-Type")
+	if len(ct) == 0 {
+		return model.MergePatch, nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, errUnsupportedPatch
+	}
+	switch mt {
+	case mergePatchType, "application/json":
+		return model.MergePatch, nil
+	case jsonPatchType:
+		return model.JSONPatch, nil
+	}
+	return nil, errUnsupportedPatch
+}
+
+// patchTrade ...serves PATCH /v1/trades/{trade_id}. The patch is applied to the
+// trade as stored and the result is committed with UpdateExistingTrade, so it
+// is validated and checked for uniqueness like a PUT, and re-applied by
+// updateFrom if another writer gets in first.
+func (h *Handler) patchTrade(r *http.Request, id string) (model.InternalTrade, error) {
+	version := apiVersion(r)
+	apply, err := patcher(r)
+	if err != nil {
+		return model.InternalTrade{}, err
+	}
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return model.InternalTrade{}, err
+	}
+	return h.updateFrom(r, id, func(current model.Trade) ([]byte, error) {
+		doc, err := current.ToJSON()
+		if err != nil {
+			return nil, err
+		}
+		merged, err := apply(doc, patch)
+		if err != nil {
+			return nil, err
+		}
+		if version != model.V1 {
+			if _, err := model.FromJSONVersion(merged, version); err != nil {
+				return nil, err
+			}
+		}
+		return merged, nil
+	})
+}
+
+// putV1Trade ...serves PUT /v1/trades/{trade_id}. v1 clients never see side,
+// account and currency, so those the body leaves out keep their stored values
+// instead of being erased.
+func (h *Handler) putV1Trade(r *http.Request, id string, body []byte) (model.InternalTrade, error) {
+	return h.updateFrom(r, id, func(current model.Trade) ([]byte, error) {
+		return keepV2Fields(current, body), nil
+	})
+}
+
+// keepV2Fields returns body with the side, account and currency of stored
+// added where it has none. Bodies that are not JSON objects are returned
+// as they are, for UpdateExistingTrade to reject.
+func keepV2Fields(stored model.Trade, body []byte) []byte {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	kept := false
+	for name, v := range map[string]string{"side": string(stored.Side), "account": stored.Account, "currency": stored.Currency} {
+		if _, ok := fields[name]; ok || len(v) == 0 {
+			continue
+		}
+		fields[name], _ = json.Marshal(v)
+		kept = true
+	}
+	if !kept {
+		return body
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+// updateFrom replaces trade id with the body change derives from its stored
+// state. The update is pinned to the version change saw; if another writer
+// got in first it is derived again from the new state, unless If-Match asked
+// for a specific version.
+func (h *Handler) updateFrom(r *http.Request, id string, change func(current model.Trade) ([]byte, error)) (model.InternalTrade, error) {
+	m, err := conditionalMutation(r)
+	if err != nil {
+		return model.InternalTrade{}, err
+	}
+	for attempt := 1; ; attempt++ {
+		current, err := h.trades(r).GetTradeByID(id)
+		if err != nil {
+			return current, err
+		}
+		if m.IfVersion != nil && *m.IfVersion != current.Version {
+			return current, db.ErrVersionMismatch
+		}
+		merged, err := change(current.Trade)
+		if err != nil {
+			return current, err
+		}
+		pinned := m
+		pinned.IfVersion = &current.Version
+		ret, err := h.trades(r).UpdateExistingTrade(merged, current.ID, pinned)
+		if errors.Is(err, db.ErrVersionMismatch) && m.IfVersion == nil && attempt < patchAttempts {
+			continue
+		}
+		return ret, err
+	}
+}
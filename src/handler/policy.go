@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/clear-street/backend-screening-parthingle/src/policy"
+)
+
+// methodActions maps the methods of the trade routes to the action they perform
+var methodActions = map[string]policy.Action{
+	http.MethodGet:    policy.Read,
+	http.MethodHead:   policy.Read,
+	http.MethodPost:   policy.Create,
+	http.MethodPut:    policy.Update,
+	http.MethodPatch:  policy.Update,
+	http.MethodDelete: policy.Delete,
+}
+
+type grantKey struct{}
+
+// authorize consults the policy on whether the principal of r may perform a,
+// before the store is touched. It returns r carrying the granted scope, to
+// which trades(r) confines the store, or an error wrapping errForbidden.
+// Admins are granted every action on any trade. An empty action, from a
+// method missing from methodActions, is never granted.
+func (h *Handler) authorize(r *http.Request, a policy.Action) (*http.Request, error) {
+	if len(a) == 0 {
+		return r, errMethodNotAllowed
+	}
+	p := PrincipalOf(r)
+	scope := policy.Any
+	if !p.Admin {
+		scope = h.policy.Load().Scope(p.Roles, a)
+	}
+	if scope == policy.None {
+		return r, fmt.Errorf("%w: %s is not granted to roles %v", errForbidden, a, p.Roles)
+	}
+	return r.WithContext(context.WithValue(r.Context(), grantKey{}, scope)), nil
+}
+
+// grantOf returns the scope authorize granted r, or policy.None
+func grantOf(r *http.Request) policy.Scope {
+	scope, _ := r.Context().Value(grantKey{}).(policy.Scope)
+	return scope
+}
+
+// checkRoles returns a validation error unless the policy defines every role of k
+func (h *Handler) checkRoles(k model.NewAPIKey) error {
+	p := h.policy.Load()
+	for i, role := range k.Roles {
+		if !p.HasRole(role) {
+			return &model.ValidationError{Errors: []model.FieldError{{Index: -1, Pointer: "/roles/" + strconv.Itoa(i), Code: model.CodeInvalid,
+				Message: fmt.Sprintf("role %s is not one of %v", role, p.Roles())}}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+)
+
+const (
+	// defaultPageSize applies to v2 listings without a limit; v1 returns
+	// every trade unless asked otherwise to stay compatible
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+func badParam(name string) error {
+	return fmt.Errorf("%w: bad %s parameter", db.ErrInvalidQuery, name)
+}
+
+func dateParam(v url.Values, name string) (int32, error) {
+	s := v.Get(name)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	d, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, badParam(name)
+	}
+	return int32(d), nil
+}
+
+func decimalParam(v url.Values, name string) (model.Decimal, error) {
+	s := v.Get(name)
+	if len(s) == 0 {
+		return model.Decimal{}, nil
+	}
+	d, err := model.ParseDecimal(s)
+	if err != nil {
+		return d, badParam(name)
+	}
+	return d, nil
+}
+
+// parseTradeQuery reads the filter, sort and pagination parameters of GET /trades:
+//
+//	ticker, client_trade_id_prefix, date_from, date_to, price_min, price_max,
+//	quantity_min, quantity_max, sort (field name, "-" prefix for descending),
+//	limit and cursor
+func parseTradeQuery(r *http.Request, version model.APIVersion) (db.TradeQuery, error) {
+	v := r.URL.Query()
+	q := db.TradeQuery{
+		Ticker:         v.Get("ticker"),
+		ClientIDPrefix: v.Get("client_trade_id_prefix"),
+		Cursor:         v.Get("cursor"),
+	}
+	var err error
+	if q.DateFrom, err = dateParam(v, "date_from"); err != nil {
+		return q, err
+	}
+	if q.DateTo, err = dateParam(v, "date_to"); err != nil {
+		return q, err
+	}
+	if q.PriceMin, err = decimalParam(v, "price_min"); err != nil {
+		return q, err
+	}
+	if q.PriceMax, err = decimalParam(v, "price_max"); err != nil {
+		return q, err
+	}
+	if q.QuantityMin, err = decimalParam(v, "quantity_min"); err != nil {
+		return q, err
+	}
+	if q.QuantityMax, err = decimalParam(v, "quantity_max"); err != nil {
+		return q, err
+	}
+
+	if s := v.Get("sort"); len(s) > 0 {
+		q.Desc = strings.HasPrefix(s, "-")
+		q.SortBy = strings.TrimPrefix(s, "-")
+		if !db.ValidSortField(q.SortBy) {
+			return q, badParam("sort")
+		}
+	}
+
+	if version != model.V1 {
+		q.Limit = defaultPageSize
+	}
+	if s := v.Get("limit"); len(s) > 0 {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return q, badParam("limit")
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// nextLink returns the URL of the page after the current one
+func nextLink(r *http.Request, next string) string {
+	u := *r.URL
+	v := u.Query()
+	v.Set("cursor", next)
+	u.RawQuery = v.Encode()
+	return u.RequestURI()
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func readBody(res *http.Response) []byte {
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	return b
+}
+
+func parseInternalTradeID(b []byte) string {
+	t := model.InternalTrade{}
+	json.Unmarshal(b, &t)
+	return t.ID
+}
+
+// TestStressAllEndpointsInParallel is meant to be run with -race (make race).
+func TestStressAllEndpointsInParallel(t *testing.T) {
+	h := New(db.NewMemoryStore())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	do := func(method, path, body string) (*http.Response, error) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				post := fmt.Sprintf(`[{"client_trade_id":"C-%d-%d","date":20200101,"quantity":"1","price":"1.00","ticker":"T%d-%d"}]`, i, j, i, j)
+				res, err := do(http.MethodPost, "/v1/trades", post)
+				if !assert.Nil(t, err) {
+					return
+				}
+				trades, err := getParsedTradeObjects(readBody(res))
+				if !assert.Equal(t, http.StatusOK, res.StatusCode) || !assert.Nil(t, err) {
+					return
+				}
+				id := trades[0].TradeID
+
+				res, err = do(http.MethodGet, "/v1/trades", "")
+				if assert.Nil(t, err) {
+					readBody(res)
+					assert.Equal(t, http.StatusOK, res.StatusCode)
+				}
+
+				res, err = do(http.MethodGet, "/v1/trades/"+id, "")
+				if assert.Nil(t, err) {
+					readBody(res)
+					assert.Equal(t, http.StatusOK, res.StatusCode)
+				}
+
+				put := fmt.Sprintf(`{"client_trade_id":"P-%d-%d","date":20200101,"quantity":"2","price":"2.00","ticker":"P%d-%d"}`, i, j, i, j)
+				res, err = do(http.MethodPut, "/v1/trades/"+id, put)
+				if !assert.Nil(t, err) {
+					return
+				}
+				updated := readBody(res)
+				if !assert.Equal(t, http.StatusOK, res.StatusCode, string(updated)) {
+					return
+				}
+				id = parseInternalTradeID(updated)
+
+				res, err = do(http.MethodDelete, "/v1/trades/"+id, "")
+				if assert.Nil(t, err) {
+					readBody(res)
+					assert.Equal(t, http.StatusOK, res.StatusCode)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	res, err := do(http.MethodGet, "/v1/trades", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "[]", string(readBody(res)), "Every trade should have been deleted")
+}
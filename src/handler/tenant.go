@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+	"github.com/clear-street/backend-screening-parthingle/src/router"
+)
+
+const (
+	// tenantParam names a tenant's book in a route
+	tenantParam = "{tenant:[a-z0-9][a-z0-9-]*}"
+	// tenantPrefix is prepended to the trade routes to address a tenant's book
+	tenantPrefix = "/{version:v1|v2}/tenants/" + tenantParam
+)
+
+// quotas ...the most trades each tenant's book may hold; 0 is unlimited
+type quotas struct {
+	max       int64
+	perTenant map[string]int64
+}
+
+// of returns the quota of tenant's book
+func (q *quotas) of(tenant string) int {
+	if n, ok := q.perTenant[tenant]; ok {
+		return int(n)
+	}
+	return int(q.max)
+}
+
+// tenant returns the book addressed by r: the one in its path, otherwise the
+// book of its API key, otherwise the default book
+func tenant(r *http.Request) string {
+	if t := router.Param(r, "tenant"); len(t) > 0 {
+		return t
+	}
+	if t := PrincipalOf(r).Tenant; len(t) > 0 {
+		return t
+	}
+	return db.DefaultTenant
+}
+
+// permits reports whether p may use tenant's book
+func (p Principal) permits(tenant string) bool {
+	return len(p.Tenant) == 0 || p.Tenant == tenant
+}
+
+// insertMutation is mutation(r) bound by the quota of the book r addresses
+func (h *Handler) insertMutation(r *http.Request) db.Mutation {
+	m := mutation(r)
+	m.MaxTrades = h.quotas.Load().of(tenant(r))
+	return m
+}
@@ -1,33 +1,314 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/clear-street/backend-screening-parthingle/src/config"
+	"github.com/clear-street/backend-screening-parthingle/src/db"
 	"github.com/clear-street/backend-screening-parthingle/src/handler"
+	"github.com/clear-street/backend-screening-parthingle/src/metrics"
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/clear-street/backend-screening-parthingle/src/policy"
 )
 
-func port() string {
-	port := os.Getenv("PORT")
-	if len(port) == 0 {
-		port = "8080"
+// store opens the backend named by c
+func store(c config.Store) (db.TradeStore, error) {
+	switch c.Backend {
+	case "memory":
+		return db.NewMemoryStore(), nil
+	case "file":
+		return db.OpenFileStore(db.FileOptions{Dir: c.Dir})
+	case "sql":
+		return db.OpenSQLStore(filepath.Join(c.Dir, "trades.sqlite"))
 	}
-	return ":" + port
+	return nil, errors.New("unknown store backend " + c.Backend)
+}
+
+// loadPolicy loads the policy file at path, or the default policy if there is none
+func loadPolicy(path string) (*policy.Policy, error) {
+	if len(path) == 0 {
+		return policy.Default(), nil
+	}
+	return policy.Load(path)
+}
+
+// reloadConfig loads the configuration and its policy file again, as on
+// SIGHUP, and returns current with the reloadable settings applied, the
+// policy, and the changed settings that need a restart. On error current
+// is to be kept.
+func reloadConfig(current config.Config, args []string, getenv func(string) string) (config.Config, *policy.Policy, []string, error) {
+	next, err := config.Load(args, getenv)
+	if err != nil {
+		return current, nil, nil, err
+	}
+	pol, err := loadPolicy(next.Auth.PolicyFile)
+	if err != nil {
+		return current, nil, nil, err
+	}
+	c, pending := config.Reload(current, next)
+	return c, pol, pending, nil
+}
+
+func handlerOptions(c config.Config, p *policy.Policy) handler.Options {
+	return handler.Options{
+		IdempotencyWindow:     c.IdempotencyWindow,
+		IdempotencyMaxEntries: int(c.IdempotencyMaxEntries),
+		MaxBodyBytes:          c.MaxBodyBytes,
+		Build:                 buildInfo(),
+		RequireAuth:           c.Auth.Enabled,
+		AdminKeys:             c.Auth.AdminKeys,
+		MaxTrades:             c.Tenants.MaxTrades,
+		TenantQuotas:          c.Tenants.Quotas,
+		Policy:                p,
+	}
+}
+
+// server returns an http.Server for h listening and timing out as configured by c
+func server(c config.Config, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              c.Listen,
+		Handler:           h,
+		ReadHeaderTimeout: c.Timeouts.ReadHeader,
+		ReadTimeout:       c.Timeouts.Read,
+		WriteTimeout:      c.Timeouts.Write,
+		IdleTimeout:       c.Timeouts.Idle,
+	}
+}
+
+// serve runs srv until its listener fails or SIGINT or SIGTERM arrives,
+// calling reload on every SIGHUP. It then calls draining, stops accepting
+// connections and waits up to the duration draining returned for in-flight
+// requests.
+func serve(srv *http.Server, tls config.TLS, reload func(), draining func() time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		if len(tls.CertFile) > 0 {
+			errs <- srv.ListenAndServeTLS(tls.CertFile, tls.KeyFile)
+			return
+		}
+		errs <- srv.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for waiting := true; waiting; {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			slog.Info("draining connections", "signal", sig.String())
+			waiting = false
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), draining())
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return errors.New("could not drain connections: " + err.Error())
+	}
+	return nil
+}
+
+// Set at build time with -ldflags "-X main.commit=... -X main.buildTime=..."
+var (
+	commit    string
+	buildTime string
+)
+
+// buildInfo identifies this build, falling back to what the Go toolchain
+// recorded when the ldflags were not given
+func buildInfo() model.BuildInfo {
+	info := model.BuildInfo{Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && len(info.Commit) == 0 {
+				info.Commit = s.Value
+			}
+			if s.Key == "vcs.time" && len(info.BuildTime) == 0 {
+				info.BuildTime = s.Value
+			}
+		}
+	}
+	if len(info.Commit) == 0 {
+		info.Commit = "unknown"
+	}
+	if len(info.BuildTime) == 0 {
+		info.BuildTime = "unknown"
+	}
+	return info
 }
 
 func echo(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("hit echo")
-	message := r.URL.Query()["message"][0]
+	message, ok := r.URL.Query()["message"]
+	if !ok {
+		http.Error(w, "missing message query parameter", http.StatusBadRequest)
+		return
+	}
+	handler.Logger(r).Debug("echo", "message", message[0])
 
 	w.Header().Add("Content-Type", "text/plain")
-	fmt.Fprintf(w, message)
+	io.WriteString(w, message[0])
+}
+
+// probeURL returns the URL the server configured by c answers on from
+// inside its own host or container
+func probeURL(c config.Config) string {
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		host, port = "", strings.TrimPrefix(c.Listen, ":")
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	scheme := "http"
+	if len(c.TLS.CertFile) > 0 {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// health probes /healthz and /readyz of the server configured by the same
+// flags, environment and config file, as the container's HEALTHCHECK, and
+// returns the exit status
+func health(args []string) int {
+	c, err := config.Load(args, os.Getenv)
+	if err != nil {
+		slog.Error("could not load configuration", "error", err.Error())
+		return 1
+	}
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		// The certificate names the server's public host, not the loopback
+		// address probed, and only liveness is being checked
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	base := probeURL(c)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := client.Get(base + path)
+		if err != nil {
+			slog.Error("health check failed", "url", base+path, "error", err.Error())
+			return 1
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			slog.Error("health check failed", "url", base+path, "status", resp.StatusCode)
+			return 1
+		}
+	}
+	return 0
+}
+
+// fatal logs msg and err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err.Error())
+	os.Exit(1)
 }
+
 func main() {
-	fmt.Println("Listening on " + port())
-	http.HandleFunc("/v1/echo", echo)
-	http.HandleFunc("/v1/trades", handler.TradesHandlerFunc)
-	http.HandleFunc("/v1/trades/", handler.TradeHandlerFunc)
-	http.ListenAndServe(port(), nil)
+	if len(os.Args) > 1 && os.Args[1] == "health" {
+		os.Exit(health(os.Args[2:]))
+	}
+
+	// Everything is logged as JSON lines to stderr, at the configured level
+	// once the configuration has been loaded
+	level := &slog.LevelVar{}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(log)
 
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		fatal("could not load configuration", err)
+	}
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	log.Info("starting", "build", buildInfo())
+	log.Info("loaded configuration", "config", cfg)
+	if !cfg.Auth.Enabled {
+		log.Warn("authentication is disabled; every client can read and change every trade")
+	}
+
+	pol, err := loadPolicy(cfg.Auth.PolicyFile)
+	if err != nil {
+		fatal("could not load policy", err)
+	}
+
+	s, err := store(cfg.Store)
+	if err != nil {
+		fatal("could not open store", err)
+	}
+	if m, ok := s.(db.LegacyIDMigrator); ok {
+		n, err := m.MigrateLegacyIDs()
+		if err != nil {
+			fatal("could not migrate legacy trade IDs", err)
+		}
+		if n > 0 {
+			log.Info("migrated trades from legacy IDs", "count", n)
+		}
+	}
+	metrics.NewGaugeFunc("trades_stored", "Trades currently in the store.", func() float64 {
+		n, err := s.CountTrades()
+		if err != nil {
+			log.Error("could not count trades", "error", err.Error())
+		}
+		return float64(n)
+	})
+	h := handler.NewWithOptions(db.Instrument(s), handlerOptions(cfg, pol))
+	h.Handle("/v1/echo", echo, http.MethodGet)
+	h.Handle("/metrics", metrics.Default.ServeHTTP, http.MethodGet)
+	reload := func() {
+		next, nextPol, pending, err := reloadConfig(cfg, os.Args[1:], os.Getenv)
+		if err != nil {
+			log.Error("keeping current configuration", "error", err.Error())
+			return
+		}
+		cfg, pol = next, nextPol
+		h.SetOptions(handlerOptions(cfg, pol))
+		level.UnmarshalText([]byte(cfg.LogLevel))
+		log.Info("reloaded configuration", "config", cfg)
+		if len(pending) > 0 {
+			log.Warn("restart to apply configuration changes", "settings", pending)
+		}
+	}
+
+	srv := server(cfg, h)
+	srv.ErrorLog = slog.NewLogLogger(log.Handler(), slog.LevelWarn)
+	log.Info("listening", "addr", cfg.Listen, "tls", len(cfg.TLS.CertFile) > 0)
+	status := 0
+	draining := func() time.Duration {
+		h.Drain()
+		return cfg.Timeouts.Shutdown
+	}
+	if err := serve(srv, cfg.TLS, reload, draining); err != nil {
+		log.Error("server stopped", "error", err.Error())
+		status = 1
+	}
+	// Flush the store only once no request can still be writing to it
+	if c, ok := s.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Error("could not close store", "error", err.Error())
+			status = 1
+		}
+	}
+	if status == 0 {
+		log.Info("stopped")
+	}
+	os.Exit(status)
 }
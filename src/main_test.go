@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clear-street/backend-screening-parthingle/src/config"
+	"github.com/clear-street/backend-screening-parthingle/src/db"
+	"github.com/clear-street/backend-screening-parthingle/src/handler"
+	"github.com/clear-street/backend-screening-parthingle/src/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfigReloadsPolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`roles: {trader: [read:own, create]}`), 0644))
+	vars := map[string]string{"ADMIN_API_KEYS": "root-key", "POLICY_FILE": path}
+	getenv := func(k string) string { return vars[k] }
+
+	cfg, err := config.Load(nil, getenv)
+	assert.Nil(t, err)
+	pol, err := loadPolicy(cfg.Auth.PolicyFile)
+	assert.Nil(t, err)
+	h := handler.NewWithOptions(db.NewMemoryStore(), handlerOptions(cfg, pol))
+	serve := func(method, url, key, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := serve("POST", "/v1/api-keys", "root-key", `{"client_id":"alice","roles":["trader"]}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	issued := model.IssuedAPIKey{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &issued))
+	trader := issued.Key
+	post := func(ticker string) int {
+		return serve("POST", "/v1/trades", trader, `[{"client_trade_id":"`+ticker+`","date":20200101,"quantity":"1","price":"1","ticker":"`+ticker+`"}]`).Code
+	}
+	history := func() int {
+		return serve("GET", "/v1/trades/by-client-id/A/history", trader, "").Code
+	}
+	assert.Equal(t, http.StatusOK, post("A"))
+	assert.Equal(t, http.StatusForbidden, history())
+
+	// As on SIGHUP: traders lose create and gain history
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`roles: {trader: [read:own, history:own]}`), 0644))
+	cfg, pol, _, err = reloadConfig(cfg, nil, getenv)
+	assert.Nil(t, err)
+	h.SetOptions(handlerOptions(cfg, pol))
+	assert.Equal(t, http.StatusForbidden, post("B"), "The reloaded policy revokes create")
+	assert.Equal(t, http.StatusOK, history(), "The reloaded policy grants history")
+
+	// A bad policy file is rejected, and the caller keeps the current one
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`roles: {trader: [trade]}`), 0644))
+	_, _, _, err = reloadConfig(cfg, nil, getenv)
+	assert.NotNil(t, err)
+	vars["POLICY_FILE"] = filepath.Join(dir, "missing.yaml")
+	_, _, _, err = reloadConfig(cfg, nil, getenv)
+	assert.NotNil(t, err)
+}
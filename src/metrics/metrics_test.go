@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpositionFormat(t *testing.T) {
+	c := NewCounter("test_events_total", "Events seen.\nBy kind.", "kind")
+	c.Inc("a")
+	c.Add(2.5, `quo"te\`)
+	c.Inc("a")
+	h := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "read")
+	h.Observe(0.1, "read")
+	h.Observe(3, "read")
+	NewGaugeFunc("test_size", "Size.", func() float64 { return 42 })
+
+	assert.Equal(t, float64(2), c.Value("a"))
+	assert.Equal(t, float64(0), c.Value("never"))
+	assert.Equal(t, uint64(3), h.Count("read"))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	Default.ServeHTTP(rr, req)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rr.Header().Get("Content-Type"))
+	body := rr.Body.String()
+
+	assert.Contains(t, body, `# HELP test_events_total Events seen.\nBy kind.
+# TYPE test_events_total counter
+test_events_total{kind="a"} 2
+test_events_total{kind="quo\"te\\"} 2.5
+`)
+	assert.Contains(t, body, `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="read",le="0.1"} 2
+test_latency_seconds_bucket{op="read",le="1"} 2
+test_latency_seconds_bucket{op="read",le="+Inf"} 3
+test_latency_seconds_sum{op="read"} 3.15
+test_latency_seconds_count{op="read"} 3
+`)
+	assert.Contains(t, body, "# TYPE test_size gauge\ntest_size 42\n")
+	assert.True(t, strings.Index(body, "test_events_total") < strings.Index(body, "test_latency_seconds"), "Metrics are sorted by name")
+
+	assert.Panics(t, func() { NewCounter("test_events_total", "Again.") }, "Names are unique")
+	assert.Panics(t, func() { c.Inc() }, "Every label needs a value")
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIKey ...an API key as stored and listed; the key itself is only ever
+// returned once, in the IssuedAPIKey that creates it
+type APIKey struct {
+	ID string `json:"id"`
+	// Tenant is the only book the key gives access to
+	Tenant string `json:"tenant"`
+	// ClientID owns the trades posted with the key
+	ClientID string `json:"client_id"`
+	// Admin keys see and change every client's trades of the book and manage its keys
+	Admin bool `json:"admin"`
+	// Roles name the grants of the server's policy that the key has
+	Roles     []string  `json:"roles,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewAPIKey ...body of POST /v1/api-keys
+type NewAPIKey struct {
+	ClientID string   `json:"client_id"`
+	Admin    bool     `json:"admin"`
+	Roles    []string `json:"roles"`
+}
+
+// APIKeyFromJSON parses and validates the body of POST /v1/api-keys
+func APIKeyFromJSON(b []byte) (NewAPIKey, error) {
+	k := NewAPIKey{}
+	if err := json.Unmarshal(b, &k); err != nil {
+		return k, badJSON()
+	}
+	if len(strings.TrimSpace(k.ClientID)) == 0 {
+		return k, &ValidationError{Errors: []FieldError{{Index: -1, Pointer: "/client_id", Code: CodeMissing, Message: "client_id is required"}}}
+	}
+	for i, role := range k.Roles {
+		if len(role) == 0 || strings.ContainsAny(role, ", ") {
+			return k, &ValidationError{Errors: []FieldError{{Index: -1, Pointer: "/roles/" + strconv.Itoa(i), Code: CodeInvalid, Message: "roles must be non-empty names without commas or spaces"}}}
+		}
+	}
+	return k, nil
+}
+
+// IssuedAPIKey ...response to POST /v1/api-keys, carrying the key to authenticate with
+type IssuedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
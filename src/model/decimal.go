@@ -0,0 +1,301 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Decimal ...exact fixed-point decimal number.
+//
+// A Decimal keeps the text it was parsed from so that it marshals back to
+// exactly the same bytes (e.g. "10.00" stays "10.00"); arithmetic is done on
+// an unscaled big integer and a base-10 scale, so no float rounding occurs.
+// Results of arithmetic are formatted at their natural scale.
+type Decimal struct {
+	text string
+}
+
+var (
+	errBadDecimal = errors.New("bad decimal format")
+	errDivByZero  = errors.New("decimal division by zero")
+	bigTen        = big.NewInt(10)
+)
+
+// ParseDecimal parses s, which must match ^[-]?[0-9]*\.?[0-9]+$
+func ParseDecimal(s string) (Decimal, error) {
+	d := Decimal{text: s}
+	if !d.Valid() {
+		return Decimal{}, errBadDecimal
+	}
+
+	return d, nil
+}
+
+// MustParseDecimal is like ParseDecimal but panics on malformed input
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(fmt.Sprintf("model: cannot parse %q as Decimal", s))
+	}
+
+	return d
+}
+
+// NewDecimal returns unscaled * 10^-scale
+func NewDecimal(unscaled int64, scale int32) Decimal {
+	return fromBig(big.NewInt(unscaled), scale)
+}
+
+// Valid reports whether d holds a well-formed decimal. The zero Decimal is not valid.
+func (d Decimal) Valid() bool {
+	s := d.text
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	}
+	dot := strings.IndexByte(s, '.')
+	intPart, frac := s, ""
+	if dot >= 0 {
+		intPart, frac = s[:dot], s[dot+1:]
+		if len(frac) == 0 {
+			return false
+		}
+	} else if len(s) == 0 {
+		return false
+	}
+
+	return allDigits(intPart) && allDigits(frac)
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parts returns the unscaled value and scale; invalid decimals are treated as zero
+func (d Decimal) parts() (*big.Int, int32) {
+	if !d.Valid() {
+		return new(big.Int), 0
+	}
+	s := d.text
+	var scale int32
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		scale = int32(len(s) - dot - 1)
+		s = s[:dot] + s[dot+1:]
+	}
+	n, _ := new(big.Int).SetString(s, 10)
+
+	return n, scale
+}
+
+func fromBig(n *big.Int, scale int32) Decimal {
+	if scale < 0 {
+		n = new(big.Int).Mul(n, pow10(-scale))
+		scale = 0
+	}
+	neg := n.Sign() < 0
+	digits := new(big.Int).Abs(n).String()
+	if scale > 0 {
+		if pad := int(scale) + 1 - len(digits); pad > 0 {
+			digits = strings.Repeat("0", pad) + digits
+		}
+		cut := len(digits) - int(scale)
+		digits = digits[:cut] + "." + digits[cut:]
+	}
+	if neg {
+		digits = "-" + digits
+	}
+
+	return Decimal{text: digits}
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// align returns the unscaled values of a and b at their common (larger) scale
+func align(a, b Decimal) (*big.Int, *big.Int, int32) {
+	x, xs := a.parts()
+	y, ys := b.parts()
+	switch {
+	case xs < ys:
+		x.Mul(x, pow10(ys-xs))
+		return x, y, ys
+	case ys < xs:
+		y.Mul(y, pow10(xs-ys))
+	}
+
+	return x, y, xs
+}
+
+// String returns d exactly as parsed or formatted
+func (d Decimal) String() string {
+	return d.text
+}
+
+// Canonical returns the shortest form of d: no redundant leading or trailing
+// zeros, a leading "0" before the point and no negative zero
+func (d Decimal) Canonical() string {
+	n, scale := d.parts()
+	if n.Sign() == 0 {
+		return "0"
+	}
+	r := new(big.Int)
+	for scale > 0 {
+		q, m := new(big.Int).QuoRem(n, bigTen, r)
+		if m.Sign() != 0 {
+			break
+		}
+		n = q
+		scale--
+	}
+
+	return fromBig(n, scale).text
+}
+
+// Scale returns the number of digits after the decimal point
+func (d Decimal) Scale() int32 {
+	_, scale := d.parts()
+	return scale
+}
+
+// Sign returns -1, 0 or +1
+func (d Decimal) Sign() int {
+	n, _ := d.parts()
+	return n.Sign()
+}
+
+// IsZero reports whether d is numerically zero
+func (d Decimal) IsZero() bool {
+	return d.Sign() == 0
+}
+
+// Cmp compares d and e numerically, returning -1, 0 or +1; "10.0" equals "10"
+func (d Decimal) Cmp(e Decimal) int {
+	x, y, _ := align(d, e)
+	return x.Cmp(y)
+}
+
+// Equal reports whether d and e are numerically equal
+func (d Decimal) Equal(e Decimal) bool {
+	return d.Cmp(e) == 0
+}
+
+// Add returns d + e at the larger of the two scales
+func (d Decimal) Add(e Decimal) Decimal {
+	x, y, scale := align(d, e)
+	return fromBig(x.Add(x, y), scale)
+}
+
+// Sub returns d - e at the larger of the two scales
+func (d Decimal) Sub(e Decimal) Decimal {
+	x, y, scale := align(d, e)
+	return fromBig(x.Sub(x, y), scale)
+}
+
+// Mul returns d * e at the sum of the two scales
+func (d Decimal) Mul(e Decimal) Decimal {
+	x, xs := d.parts()
+	y, ys := e.parts()
+	return fromBig(x.Mul(x, y), xs+ys)
+}
+
+// Neg returns -d
+func (d Decimal) Neg() Decimal {
+	n, scale := d.parts()
+	return fromBig(n.Neg(n), scale)
+}
+
+// Abs returns |d|
+func (d Decimal) Abs() Decimal {
+	n, scale := d.parts()
+	return fromBig(n.Abs(n), scale)
+}
+
+// Round returns d rounded half away from zero to the given scale; a larger
+// scale pads with zeros
+func (d Decimal) Round(scale int32) Decimal {
+	n, s := d.parts()
+	if scale >= s {
+		return fromBig(n.Mul(n, pow10(scale-s)), scale)
+	}
+
+	return fromBig(roundQuo(n, pow10(s-scale)), scale)
+}
+
+// Quo returns d / e rounded half away from zero to the given scale
+func (d Decimal) Quo(e Decimal, scale int32) (Decimal, error) {
+	x, xs := d.parts()
+	y, ys := e.parts()
+	if y.Sign() == 0 {
+		return Decimal{}, errDivByZero
+	}
+	// x*10^-xs / y*10^-ys = (x*10^(scale+ys-xs) / y) * 10^-scale
+	shift := scale + ys - xs
+	if shift >= 0 {
+		x.Mul(x, pow10(shift))
+	} else {
+		y.Mul(y, pow10(-shift))
+	}
+
+	return fromBig(roundQuo(x, y), scale), nil
+}
+
+// roundQuo returns x / y rounded half away from zero
+func roundQuo(x, y *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(x, y, new(big.Int))
+	r.Abs(r).Lsh(r, 1)
+	if r.Cmp(new(big.Int).Abs(y)) >= 0 {
+		if x.Sign()*y.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+
+	return q
+}
+
+// MarshalJSON writes d as a JSON string with the exact text it holds
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.text)
+}
+
+// UnmarshalJSON accepts any JSON string; well-formedness is checked by
+// validTrade so that errors name the offending field
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	d.text = s
+
+	return nil
+}
+
+// Value implements driver.Valuer so decimals are stored as exact text
+func (d Decimal) Value() (driver.Value, error) {
+	return d.text, nil
+}
+
+// Scan implements sql.Scanner
+func (d *Decimal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		d.text = v
+	case []byte:
+		d.text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Decimal", src)
+	}
+
+	return nil
+}
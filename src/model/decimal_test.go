@@ -0,0 +1,89 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDecimalGrammar(t *testing.T) {
+	for _, s := range []string{"0", "10", "10.00", "-5.67", ".5", "-.5", "007"} {
+		_, err := ParseDecimal(s)
+		assert.Nil(t, err, s)
+	}
+	for _, s := range []string{"", "-", ".", "5.", "1q0", "1.2.3", "+1", " 1", "1e5"} {
+		_, err := ParseDecimal(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestDecimalJSONIsByteCompatible(t *testing.T) {
+	JSON := `{"client_trade_id":"12345","date":20010101,"quantity":"-.50","price":"10.00","ticker":"PRTH"}`
+	trade := Trade{}
+	assert.Nil(t, json.Unmarshal([]byte(JSON), &trade))
+	out, err := trade.ToJSON()
+	assert.Nil(t, err)
+	assert.Equal(t, JSON, string(out))
+}
+
+func TestDecimalCanonical(t *testing.T) {
+	cases := map[string]string{
+		"10.00":  "10",
+		".5":     "0.5",
+		"-0.0":   "0",
+		"007.10": "7.1",
+		"-1.230": "-1.23",
+		"100":    "100",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, MustParseDecimal(in).Canonical(), in)
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	d := MustParseDecimal
+	assert.Equal(t, "0.3", d("0.1").Add(d("0.2")).String(), "No float rounding")
+	assert.Equal(t, "9.50", d("10").Sub(d("0.50")).String())
+	assert.Equal(t, "56.700", d("10").Mul(d("5.670")).String())
+	assert.Equal(t, "-1.50", d("-3.0").Mul(d("0.5")).String())
+	assert.Equal(t, "5.67", d("-5.67").Neg().String())
+	assert.Equal(t, "5.67", d("-5.67").Abs().String())
+	assert.Equal(t, "0.000001", NewDecimal(1, 6).String())
+	assert.Equal(t, "-12.3", NewDecimal(-123, 1).String())
+}
+
+func TestDecimalRoundAndQuo(t *testing.T) {
+	d := MustParseDecimal
+	assert.Equal(t, "1.24", d("1.235").Round(2).String())
+	assert.Equal(t, "-1.24", d("-1.235").Round(2).String())
+	assert.Equal(t, "1.2300", d("1.23").Round(4).String())
+	assert.Equal(t, "2", d("1.5").Round(0).String())
+
+	q, err := d("1").Quo(d("3"), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, "0.3333", q.String())
+	q, err = d("2").Quo(d("-3"), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "-0.67", q.String())
+	q, err = d("12.5").Quo(d("0.25"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "50", q.String())
+	_, err = d("1").Quo(d("0.00"), 2)
+	assert.NotNil(t, err)
+}
+
+func TestDecimalCmp(t *testing.T) {
+	d := MustParseDecimal
+	assert.True(t, d("10").Equal(d("10.000")))
+	assert.Equal(t, -1, d("9.99").Cmp(d("10")))
+	assert.Equal(t, 1, d("-1").Cmp(d("-1.5")))
+	assert.Equal(t, 0, d("-0").Cmp(d("0.0")))
+	assert.True(t, d("0.00").IsZero())
+	assert.Equal(t, int32(2), d("10.00").Scale())
+}
+
+func TestTradeNotional(t *testing.T) {
+	trade := Trade{Quantity: MustParseDecimal("100"), Price: MustParseDecimal("10.05")}
+	assert.Equal(t, "1005.00", trade.Notional().String())
+}
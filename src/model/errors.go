@@ -0,0 +1,87 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/clear-street/backend-screening-parthingle/src/metrics"
+)
+
+var validationFailures = metrics.NewCounter("trades_validation_failures_total",
+	"Trade fields rejected while parsing request bodies, by field and reason.", "field", "code")
+
+// Validation error codes reported in FieldError.Code
+const (
+	// CodeInvalidJSON means the body is not a JSON trade or array of trades
+	CodeInvalidJSON = "invalid_json"
+	// CodeInvalidType means a field has the wrong JSON type
+	CodeInvalidType = "invalid_type"
+	// CodeMissing means a required field is absent or empty
+	CodeMissing = "missing"
+	// CodeInvalid means a field is present but its value is not acceptable
+	CodeInvalid = "invalid"
+)
+
+// FieldError ...one failing field of one trade in a request body
+type FieldError struct {
+	// Index of the trade in the submitted array; -1 when not tied to an element
+	Index int `json:"index"`
+	// Pointer is an RFC 6901 JSON pointer to the field, e.g. "/2/price"
+	Pointer string `json:"pointer"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError ...every field-level failure found while parsing a request body
+type ValidationError struct {
+	Errors []FieldError
+}
+
+// Error returns the message of the first failure
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 0 {
+		return "validation failed"
+	}
+	return e.Errors[0].Message
+}
+
+// Malformed reports whether any failure is a syntax or type error rather
+// than a missing or unacceptable value
+func (e *ValidationError) Malformed() bool {
+	for _, fe := range e.Errors {
+		if fe.Code == CodeInvalidJSON || fe.Code == CodeInvalidType {
+			return true
+		}
+	}
+	return false
+}
+
+func badJSON() *ValidationError {
+	return &ValidationError{Errors: []FieldError{{Index: -1, Pointer: "", Code: CodeInvalidJSON, Message: "bad JSON format"}}}
+}
+
+// fieldError builds a FieldError for field; Index and Pointer are filled in by FromJSON
+func fieldError(field, code, message string) FieldError {
+	return FieldError{Pointer: "/" + field, Code: code, Message: message}
+}
+
+// count records errs, which must not have been located yet, in the
+// trades_validation_failures_total metric; failures of a whole element or
+// body have an empty field
+func count(errs []FieldError) []FieldError {
+	for _, fe := range errs {
+		validationFailures.Inc(strings.TrimPrefix(fe.Pointer, "/"), fe.Code)
+	}
+	return errs
+}
+
+// locate prefixes each error's pointer with the element index when the body is an array
+func locate(errs []FieldError, index int, array bool) []FieldError {
+	for i := range errs {
+		errs[i].Index = index
+		if array {
+			errs[i].Pointer = "/" + strconv.Itoa(index) + errs[i].Pointer
+		}
+	}
+	return errs
+}
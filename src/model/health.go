@@ -0,0 +1,13 @@
+package model
+
+// Health ...body of the /healthz and /readyz probes when they pass
+type Health struct {
+	Status string `json:"status"`
+}
+
+// BuildInfo ...body of /version, identifying the running build
+type BuildInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+// Action ...kind of mutation recorded in a trade's history
+type Action string
+
+// Recorded actions
+const (
+	ActionCreated Action = "created"
+	ActionUpdated Action = "updated"
+	ActionDeleted Action = "deleted"
+)
+
+// TradeVersion ...immutable record of one mutation of a trade. Versions of a
+// trade are numbered from 1 in the order they were committed.
+type TradeVersion struct {
+	TradeID string    `json:"trade_id"`
+	Version int       `json:"version"`
+	Action  Action    `json:"action"`
+	Actor   string    `json:"actor"`
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+	// Before is absent for ActionCreated and After for ActionDeleted
+	Before *Trade `json:"before,omitempty"`
+	After  *Trade `json:"after,omitempty"`
+}
+
+// ForVersion returns tv as represented in the given API version
+func (tv TradeVersion) ForVersion(v APIVersion) TradeVersion {
+	if tv.Before != nil {
+		before := tv.Before.ForVersion(v)
+		tv.Before = &before
+	}
+	if tv.After != nil {
+		after := tv.After.ForVersion(v)
+		tv.After = &after
+	}
+	return tv
+}
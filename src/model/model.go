@@ -4,22 +4,81 @@ import (
 	"encoding/json"
 	"errors"
 	"reflect"
-	"regexp"
 )
 
 // Trade ...Base trade details; common amongst all trade types
 type Trade struct {
-	ClientTradeID string `json:"client_trade_id"`
-	Date          int32  `json:"date"`
-	Quantity      string `json:"quantity"`
-	Price         string `json:"price"`
-	Ticker        string `json:"ticker"`
+	ClientTradeID string  `json:"client_trade_id"`
+	Date          int32   `json:"date"`
+	Quantity      Decimal `json:"quantity"`
+	Price         Decimal `json:"price"`
+	Ticker        string  `json:"ticker"`
+	// Side, Account and Currency are part of the v2 API; they are optional
+	// in v1 and omitted from v1 representations
+	Side     Side   `json:"side,omitempty"`
+	Account  string `json:"account,omitempty"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// Side ...direction of a trade
+type Side string
+
+// Valid trade sides
+const (
+	SideBuy        Side = "buy"
+	SideSell       Side = "sell"
+	SideShortSell  Side = "short_sell"
+	SideBuyToCover Side = "buy_to_cover"
+)
+
+// Valid reports whether s is one of the known sides
+func (s Side) Valid() bool {
+	switch s {
+	case SideBuy, SideSell, SideShortSell, SideBuyToCover:
+		return true
+	}
+	return false
+}
+
+// APIVersion ...version of the public trades API a request was made against
+type APIVersion int
+
+// Supported API versions
+const (
+	V1 APIVersion = 1
+	V2 APIVersion = 2
+)
+
+// ForVersion returns t as represented in the given API version
+func (t Trade) ForVersion(v APIVersion) Trade {
+	if v == V1 {
+		t.Side, t.Account, t.Currency = "", "", ""
+	}
+	return t
+}
+
+// ForVersion returns it as represented in the given API version
+func (it InternalTrade) ForVersion(v APIVersion) InternalTrade {
+	it.Trade = it.Trade.ForVersion(v)
+	return it
 }
 
 // InternalTrade ...Internal representation of trade including id
 type InternalTrade struct {
 	ID    string `json:"id"`
 	Trade Trade  `json:"trade"`
+	// Version is the number of recorded versions of the trade; it is served as
+	// the ETag rather than in the body. 0 for trades booked before history was kept.
+	Version int `json:"-"`
+	// Owner is the client that posted the trade; empty for trades booked
+	// before API keys were issued, which only admins see
+	Owner string `json:"owner,omitempty"`
+}
+
+// TradeList ...one page of trades; Next is the cursor of the following page, if any
+type TradeList struct {
+	Trades []InternalTrade `json:"trades"`
+	Next   string          `json:"next,omitempty"`
 }
 
 // TradeSubmitted ...Submitted trade details
@@ -28,9 +87,23 @@ type TradeSubmitted struct {
 	TradeID       string `json:"trade_id"`
 }
 
+// BatchItem ...outcome of one trade of a non-atomic POST; exactly one of
+// Result and Error is set
+type BatchItem struct {
+	// Index of the trade in the submitted array
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	Result *TradeSubmitted `json:"result,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
 // Error ...human readable description of error
 type Error struct {
 	Message string `json:"message"`
+	// Errors lists every failing field when the request body did not validate
+	Errors []FieldError `json:"errors,omitempty"`
+	// RequestID is the X-Request-ID of the failed request, for finding it in the logs
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // ToJSON to be used for marshalling of Trade type
@@ -42,92 +115,228 @@ func (t Trade) ToJSON() ([]byte, error) {
 	return ToJSON, nil
 }
 
-func validTrade(trade Trade) (bool, error) {
+// Notional returns Quantity * Price exactly
+func (t Trade) Notional() Decimal {
+	return t.Quantity.Mul(t.Price)
+}
 
-	var validQuantity = regexp.MustCompile(`^[-]?[0-9]*\.?[0-9]+$`)
-	var validPrice = regexp.MustCompile(`^[-]?[0-9]*\.?[0-9]+$`)
+// validTrade returns every failing field of trade
+func validTrade(trade Trade) []FieldError {
+	errs := []FieldError{}
 
-	if len(trade.ClientTradeID) < 1 || len(trade.ClientTradeID) > 256 {
-		return false, errors.New("bad or missing client_trade_id")
+	if len(trade.ClientTradeID) < 1 {
+		errs = append(errs, fieldError("client_trade_id", CodeMissing, "bad or missing client_trade_id"))
+	} else if len(trade.ClientTradeID) > 256 {
+		errs = append(errs, fieldError("client_trade_id", CodeInvalid, "bad or missing client_trade_id"))
 	}
 
-	if trade.Date < 20010101 || trade.Date > 21000101 {
-		return false, errors.New("bad or missing date")
+	if trade.Date == 0 {
+		errs = append(errs, fieldError("date", CodeMissing, "bad or missing date"))
+	} else if trade.Date < 20010101 || trade.Date > 21000101 {
+		errs = append(errs, fieldError("date", CodeInvalid, "bad or missing date"))
 	}
 
-	if !validQuantity.MatchString(trade.Quantity) {
-		return false, errors.New("bad or missing quantity format")
+	if len(trade.Quantity.String()) < 1 {
+		errs = append(errs, fieldError("quantity", CodeMissing, "bad or missing quantity format"))
+	} else if !trade.Quantity.Valid() {
+		errs = append(errs, fieldError("quantity", CodeInvalid, "bad or missing quantity format"))
 	}
 
-	if !validPrice.MatchString(trade.Price) {
-		return false, errors.New("bad or missing price format")
+	if len(trade.Price.String()) < 1 {
+		errs = append(errs, fieldError("price", CodeMissing, "bad or missing price format"))
+	} else if !trade.Price.Valid() {
+		errs = append(errs, fieldError("price", CodeInvalid, "bad or missing price format"))
 	}
 
 	if len(trade.Ticker) < 1 {
-		return false, errors.New("bad or missing ticker format")
+		errs = append(errs, fieldError("ticker", CodeMissing, "bad or missing ticker format"))
 	}
-	return true, nil
+
+	// v2 fields are optional here; requireV2Fields enforces their presence
+	if len(trade.Side) > 0 && !trade.Side.Valid() {
+		errs = append(errs, fieldError("side", CodeInvalid, "bad or missing side"))
+	}
+
+	if len(trade.Account) > 256 {
+		errs = append(errs, fieldError("account", CodeInvalid, "bad or missing account"))
+	}
+
+	if len(trade.Currency) > 0 && !ValidCurrency(trade.Currency) {
+		errs = append(errs, fieldError("currency", CodeInvalid, "bad or missing currency"))
+	}
+	return errs
 }
 
-func parseBadMapType(m map[string]interface{}) (bool, string) {
-	if v, ok := m["client_trade_id"]; ok {
-		if reflect.TypeOf(v).String() != "string" {
-			return true, "bad client_trade_id type"
-		}
+func requireV2Fields(trade Trade) []FieldError {
+	errs := []FieldError{}
+
+	if len(trade.Side) < 1 {
+		errs = append(errs, fieldError("side", CodeMissing, "bad or missing side"))
 	}
-	if v, ok := m["date"]; ok {
-		if reflect.TypeOf(v).String() != "float64" {
-			return true, "bad date type"
-		}
+
+	if len(trade.Account) < 1 {
+		errs = append(errs, fieldError("account", CodeMissing, "bad or missing account"))
 	}
-	if v, ok := m["quantity"]; ok {
-		if reflect.TypeOf(v).String() != "string" {
-			return true, "bad quantity type"
-		}
+
+	if len(trade.Currency) < 1 {
+		errs = append(errs, fieldError("currency", CodeMissing, "bad or missing currency"))
 	}
-	if v, ok := m["price"]; ok {
-		if reflect.TypeOf(v).String() != "string" {
-			return true, "bad price type"
+	return errs
+}
+
+// tradeFieldTypes ...expected JSON type of every Trade field, in reporting order
+var tradeFieldTypes = []struct{ field, kind string }{
+	{"client_trade_id", "string"},
+	{"date", "float64"},
+	{"quantity", "string"},
+	{"price", "string"},
+	{"ticker", "string"},
+	{"side", "string"},
+	{"account", "string"},
+	{"currency", "string"},
+}
+
+// parseBadMapType returns a type error for every field of m with the wrong
+// JSON type; null is left to validTrade to report as missing
+func parseBadMapType(m map[string]interface{}) []FieldError {
+	errs := []FieldError{}
+	for _, f := range tradeFieldTypes {
+		if v, ok := m[f.field]; ok && v != nil {
+			if reflect.TypeOf(v).String() != f.kind {
+				errs = append(errs, fieldError(f.field, CodeInvalidType, "bad "+f.field+" type"))
+			}
 		}
 	}
-	if v, ok := m["ticker"]; ok {
-		if reflect.TypeOf(v).String() != "string" {
-			return true, "bad ticker type"
+	return errs
+}
+
+// decodeTrade decodes a single JSON object, reporting type errors per field
+func decodeTrade(raw json.RawMessage) (Trade, []FieldError) {
+	t := Trade{}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return t, []FieldError{{Code: CodeInvalidType, Message: "bad JSON format"}}
+	}
+	if errs := parseBadMapType(m); len(errs) > 0 {
+		return t, errs
+	}
+	if err := json.Unmarshal(raw, &t); err != nil {
+		// Right JSON type but unrepresentable, e.g. a fractional date
+		if ute, ok := err.(*json.UnmarshalTypeError); ok && len(ute.Field) > 0 {
+			return t, []FieldError{fieldError(ute.Field, CodeInvalidType, "bad "+ute.Field+" type")}
 		}
+		return t, []FieldError{{Code: CodeInvalidType, Message: "bad JSON format"}}
 	}
-	return false, ""
+	return t, nil
 }
 
-// FromJSON to be used for unmarshalling of Trade type
+// FromJSON to be used for unmarshalling of Trade type. The body may be a
+// single trade or an array of trades; on failure the error is a
+// *ValidationError listing every failing field of every element.
 func FromJSON(data []byte) ([]Trade, error) {
-
 	trades := []Trade{}
-	err := json.Unmarshal(data, &trades)
+	raws, array, err := splitTrades(data)
+	if err != nil {
+		return trades, err
+	}
+
+	verr := &ValidationError{Errors: []FieldError{}}
+	for i, raw := range raws {
+		t, errs := decodeTrade(raw)
+		if len(errs) == 0 {
+			errs = validTrade(t)
+		}
+		verr.Errors = append(verr.Errors, locate(count(errs), i, array)...)
+		trades = append(trades, t)
+	}
+	if len(verr.Errors) > 0 {
+		return trades, verr
+	}
+	return trades, nil
+}
+
+// splitTrades returns the raw elements of a body holding a trade or an array
+// of trades, and whether it was an array
+func splitTrades(data []byte) ([]json.RawMessage, bool, error) {
+	raws := []json.RawMessage{}
+	if err := json.Unmarshal(data, &raws); err == nil {
+		return raws, true, nil
+	}
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		verr := badJSON()
+		count(verr.Errors)
+		return raws, false, verr
+	}
+	return []json.RawMessage{data}, false, nil
+}
 
+// FromJSONEach is FromJSONVersion for bodies whose trades are accepted or
+// rejected individually: errs[i] is nil or the *ValidationError of trade i.
+// Only a body that is not a trade or array of trades fails as a whole.
+func FromJSONEach(data []byte, v APIVersion) ([]Trade, []error, error) {
+	trades := []Trade{}
+	errs := []error{}
+	raws, array, err := splitTrades(data)
 	if err != nil {
-		t := Trade{}
-		err = json.Unmarshal(data, &t)
-		if err != nil { // Exclusive error territory. Now need to find out what type of error
-			var emap []map[string]interface{}
-			err = json.Unmarshal(data, &emap)
-			if err != nil {
-				return trades, errors.New("bad JSON format")
-			}
-			for _, m := range emap {
-				typeerror, msg := parseBadMapType(m)
-				if typeerror {
-					return trades, errors.New(msg)
-				}
+		return trades, errs, err
+	}
+	for i, raw := range raws {
+		t, fes := decodeTrade(raw)
+		if len(fes) == 0 {
+			fes = validTrade(t)
+			if v != V1 {
+				fes = append(fes, requireV2Fields(t)...)
 			}
-		} else {
-			trades = append(trades, t)
 		}
+		trades = append(trades, t)
+		if len(fes) > 0 {
+			errs = append(errs, &ValidationError{Errors: locate(count(fes), i, array)})
+			continue
+		}
+		errs = append(errs, nil)
 	}
+	return trades, errs, nil
+}
 
-	for _, trade := range trades {
-		if valid, err := validTrade(trade); !valid {
-			return trades, err
-		}
+// TradeFromJSON parses a body that must hold exactly one trade, either as
+// an object or as a one-element array
+func TradeFromJSON(data []byte) (Trade, error) {
+	trades, err := FromJSON(data)
+	if err != nil {
+		return Trade{}, err
+	}
+	if len(trades) != 1 {
+		return Trade{}, &ValidationError{Errors: count([]FieldError{{Index: -1, Code: CodeInvalid, Message: "bad JSON format: expected a single trade"}})}
+	}
+	return trades[0], nil
+}
+
+// FromJSONVersion is FromJSON with the additional rules of API version v;
+// v2 requires side, account and currency on every trade
+func FromJSONVersion(data []byte, v APIVersion) ([]Trade, error) {
+	trades, err := FromJSON(data)
+	if err != nil || v == V1 {
+		return trades, err
+	}
+	array := len(data) > 0 && firstNonSpace(data) == '['
+	verr := &ValidationError{Errors: []FieldError{}}
+	for i, trade := range trades {
+		verr.Errors = append(verr.Errors, locate(count(requireV2Fields(trade)), i, array)...)
+	}
+	if len(verr.Errors) > 0 {
+		return trades, verr
 	}
 	return trades, nil
 }
+
+func firstNonSpace(b []byte) byte {
+	for _, c := range b {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		return c
+	}
+	return 0
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func TestTradeToJSONValid(t *testing.T) {
-	trade := Trade{ClientTradeID: "12345", Date: 20010101, Quantity: "10", Price: "5.67", Ticker: "PRTH"}
+	trade := Trade{ClientTradeID: "12345", Date: 20010101, Quantity: MustParseDecimal("10"), Price: MustParseDecimal("5.67"), Ticker: "PRTH"}
 	json, err := trade.ToJSON()
 
 	assert.Equal(t, `{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}`,
@@ -17,7 +17,7 @@ func TestTradeToJSONValid(t *testing.T) {
 }
 
 func TestTradeToJSONInvalid(t *testing.T) {
-	trade := Trade{ClientTradeID: "12345", Date: 120010101, Quantity: "10", Price: "5.67", Ticker: "PRTH"}
+	trade := Trade{ClientTradeID: "12345", Date: 120010101, Quantity: MustParseDecimal("10"), Price: MustParseDecimal("5.67"), Ticker: "PRTH"}
 	json, err := trade.ToJSON()
 
 	assert.NotEqual(t, `{"client_trade_Wrong","JSONdate":"OUTPUT_120010101","quantity":"10","price":"5.67","ticker":"PRTH"}`,
@@ -29,7 +29,7 @@ func TestFromJSONToTradeValid(t *testing.T) {
 	json := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`)
 	trade, err := FromJSON(json)
 
-	assert.Equal(t, trade[0], Trade{ClientTradeID: "12345", Date: 20010101, Quantity: "10", Price: "5.67", Ticker: "PRTH"})
+	assert.Equal(t, trade[0], Trade{ClientTradeID: "12345", Date: 20010101, Quantity: MustParseDecimal("10"), Price: MustParseDecimal("5.67"), Ticker: "PRTH"})
 	assert.Nil(t, err)
 }
 
@@ -65,3 +65,98 @@ func TestFromJSONWithBadTypesFail(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, err.Error(), "bad or missing client_trade_id", "json3 has missing client_trade_id")
 }
+
+func TestFromJSONV2Fields(t *testing.T) {
+	good := []byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH","side":"short_sell","account":"ACC-1","currency":"USD"}]`)
+	trades, err := FromJSONVersion(good, V2)
+	assert.Nil(t, err)
+	assert.Equal(t, SideShortSell, trades[0].Side)
+
+	_, err = FromJSONVersion([]byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`), V2)
+	assert.NotNil(t, err)
+	assert.Equal(t, "bad or missing side", err.Error(), "v2 requires side")
+
+	_, err = FromJSONVersion([]byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}]`), V1)
+	assert.Nil(t, err, "v1 does not require v2 fields")
+
+	_, err = FromJSON([]byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH","side":"hold"}]`))
+	assert.Equal(t, "bad or missing side", err.Error())
+
+	_, err = FromJSON([]byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH","currency":"usd"}]`))
+	assert.Equal(t, "bad or missing currency", err.Error(), "Currency codes are upper case ISO 4217")
+
+	_, err = FromJSON([]byte(`[{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH","account":7}]`))
+	assert.Equal(t, "bad account type", err.Error())
+}
+
+func TestTradeForVersionV1OmitsV2Fields(t *testing.T) {
+	trade := Trade{ClientTradeID: "12345", Date: 20010101, Quantity: MustParseDecimal("10"), Price: MustParseDecimal("5.67"), Ticker: "PRTH", Side: SideBuy, Account: "A", Currency: "EUR"}
+	json, err := trade.ForVersion(V1).ToJSON()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"client_trade_id":"12345","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"}`, string(json))
+	assert.Equal(t, trade, trade.ForVersion(V2))
+}
+
+func TestFromJSONReportsEveryFailingField(t *testing.T) {
+	json := []byte(`[{"client_trade_id":"1","date":20010101,"quantity":"10","price":"5.67","ticker":"PRTH"},{"client_trade_id":"","date":2,"quantity":"10","price":"x","ticker":"AMZN"},{"client_trade_id":"3","date":20010101,"quantity":10,"price":"5.67","ticker":"AAPL"}]`)
+	_, err := FromJSON(json)
+
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok, "FromJSON should return a *ValidationError")
+	assert.Equal(t, []FieldError{
+		{Index: 1, Pointer: "/1/client_trade_id", Code: CodeMissing, Message: "bad or missing client_trade_id"},
+		{Index: 1, Pointer: "/1/date", Code: CodeInvalid, Message: "bad or missing date"},
+		{Index: 1, Pointer: "/1/price", Code: CodeInvalid, Message: "bad or missing price format"},
+		{Index: 2, Pointer: "/2/quantity", Code: CodeInvalidType, Message: "bad quantity type"},
+	}, verr.Errors)
+	assert.True(t, verr.Malformed())
+	assert.Equal(t, "bad or missing client_trade_id", err.Error())
+}
+
+func TestFromJSONSingleObjectPointers(t *testing.T) {
+	_, err := FromJSON([]byte(`{"client_trade_id":"1","date":20010101,"quantity":"10","price":"5.67"}`))
+	verr := err.(*ValidationError)
+	assert.Equal(t, []FieldError{{Index: 0, Pointer: "/ticker", Code: CodeMissing, Message: "bad or missing ticker format"}}, verr.Errors)
+	assert.False(t, verr.Malformed())
+
+	_, err = FromJSON([]byte(`not json`))
+	verr = err.(*ValidationError)
+	assert.Equal(t, CodeInvalidJSON, verr.Errors[0].Code)
+	assert.True(t, verr.Malformed())
+
+	_, err = FromJSON([]byte(`[{"client_trade_id":"1","date":20010101.5,"quantity":"10","price":"5.67","ticker":"A"}]`))
+	assert.Equal(t, "bad date type", err.Error())
+
+	_, err = TradeFromJSON([]byte(`[]`))
+	assert.NotNil(t, err, "An update body must hold exactly one trade")
+}
+
+func TestFromJSONEachReportsPerTrade(t *testing.T) {
+	trades, errs, err := FromJSONEach([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"10","price":"5.67","ticker":"A"},{"client_trade_id":"2","date":2,"quantity":"10","price":"x","ticker":"B"},{"client_trade_id":3}]`), V1)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(trades))
+	assert.Equal(t, 3, len(errs))
+	assert.Nil(t, errs[0])
+	verr := errs[1].(*ValidationError)
+	assert.Equal(t, []string{"/1/date", "/1/price"}, []string{verr.Errors[0].Pointer, verr.Errors[1].Pointer})
+	assert.True(t, errs[2].(*ValidationError).Malformed())
+
+	_, errs, _ = FromJSONEach([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"10","price":"5.67","ticker":"A"}]`), V2)
+	assert.Equal(t, 3, len(errs[0].(*ValidationError).Errors), "v2 requires side, account and currency")
+
+	_, _, err = FromJSONEach([]byte(`not json`), V1)
+	assert.NotNil(t, err)
+}
+
+func TestFromJSONCountsValidationFailures(t *testing.T) {
+	before := func(field, code string) float64 { return validationFailures.Value(field, code) }
+	missingPrice, invalidJSON, missingSide := before("price", CodeMissing), before("", CodeInvalidJSON), before("side", CodeMissing)
+
+	FromJSON([]byte(`[{"client_trade_id":"1","date":20010101,"quantity":"10","ticker":"PRTH"},{"client_trade_id":"2","date":20010101,"quantity":"10","ticker":"AMZN"}]`))
+	FromJSON([]byte(`not json`))
+	FromJSONVersion([]byte(`{"client_trade_id":"1","date":20010101,"quantity":"10","price":"1","ticker":"PRTH"}`), V2)
+
+	assert.Equal(t, missingPrice+2, before("price", CodeMissing), "Failures are counted by field, whatever the element")
+	assert.Equal(t, invalidJSON+1, before("", CodeInvalidJSON))
+	assert.Equal(t, missingSide+1, before("side", CodeMissing))
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePatchRFC7396Examples(t *testing.T) {
+	cases := []struct{ doc, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{"date":20010101}`, `{"date":20010101.5}`, `{"date":20010101.5}`},
+	}
+	for _, c := range cases {
+		got, err := MergePatch([]byte(c.doc), []byte(c.patch))
+		assert.Nil(t, err)
+		assert.JSONEq(t, c.want, string(got), c.patch)
+	}
+
+	_, err := MergePatch([]byte(`{}`), []byte(`{"a":`))
+	assert.True(t, err.(*ValidationError).Malformed())
+}
+
+func TestJSONPatch(t *testing.T) {
+	doc := []byte(`{"ticker":"AAPL","price":"10","tags":["a","c"]}`)
+	got, err := JSONPatch(doc, []byte(`[
+		{"op":"test","path":"/ticker","value":"AAPL"},
+		{"op":"replace","path":"/price","value":"11"},
+		{"op":"add","path":"/tags/1","value":"b"},
+		{"op":"add","path":"/tags/-","value":"d"},
+		{"op":"copy","from":"/ticker","path":"/symbol"},
+		{"op":"move","from":"/symbol","path":"/alias"},
+		{"op":"remove","path":"/tags/0"}
+	]`))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"ticker":"AAPL","price":"11","tags":["b","c","d"],"alias":"AAPL"}`, string(got))
+
+	_, err = JSONPatch(doc, []byte(`[{"op":"test","path":"/ticker","value":"MSFT"}]`))
+	assert.Equal(t, ErrPatchTestFailed, err)
+
+	_, err = JSONPatch(doc, []byte(`[{"op":"replace","path":"/price","value":"11"},{"op":"remove","path":"/missing"}]`))
+	verr := err.(*ValidationError)
+	assert.Equal(t, "/1", verr.Errors[0].Pointer, "The failing operation is identified")
+	assert.False(t, verr.Malformed())
+
+	for _, patch := range []string{
+		`[{"op":"jump","path":"/a"}]`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"add","path":"a","value":1}]`,
+		`[{"op":"add","path":"/tags/9","value":1}]`,
+		`[{"op":"move","path":"/a"}]`,
+	} {
+		_, err = JSONPatch(doc, []byte(patch))
+		assert.NotNil(t, err, patch)
+	}
+	_, err = JSONPatch(doc, []byte(`{"op":"add"}`))
+	assert.True(t, err.(*ValidationError).Malformed(), "A JSON Patch must be an array")
+
+	numbers := []byte(`{"date":20200101,"lots":[10,2.50],"fee":{"amount":1e2}}`)
+	for _, patch := range []string{
+		`[{"op":"test","path":"/date","value":20200101.0}]`,
+		`[{"op":"test","path":"/lots","value":[10.0,2.5]}]`,
+		`[{"op":"test","path":"/fee","value":{"amount":100}}]`,
+	} {
+		_, err = JSONPatch(numbers, []byte(patch))
+		assert.Nil(t, err, "Numbers are compared by value: "+patch)
+	}
+	for _, patch := range []string{
+		`[{"op":"test","path":"/date","value":20200102}]`,
+		`[{"op":"test","path":"/date","value":"20200101"}]`,
+		`[{"op":"test","path":"/lots","value":[10]}]`,
+		`[{"op":"test","path":"/fee","value":{"amount":100,"currency":"USD"}}]`,
+	} {
+		_, err = JSONPatch(numbers, []byte(patch))
+		assert.Equal(t, ErrPatchTestFailed, err, patch)
+	}
+
+	got, err = JSONPatch(doc, []byte(`[{"op":"replace","path":"","value":{"ticker":"MSFT"}}]`))
+	assert.Nil(t, err, "Replacing the root replaces the whole document")
+	assert.JSONEq(t, `{"ticker":"MSFT"}`, string(got))
+}
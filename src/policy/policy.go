@@ -0,0 +1,209 @@
+// Package policy decides which trade operations the roles of an API key permit.
+//
+// A policy grants each role a list of actions, each written action:scope.
+// The scope is own, for the trades the key's client posted, or any, for
+// every trade of the book; an action without a scope is granted on any
+// trade. Keys with no role get the policy's default grants instead.
+//
+//	default: [read:own, history:own, create, update:own]
+//	roles:
+//	  trader: [read:own, history:own, create, update:own]
+//	  supervisor: [read, history, delete]
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrInvalid is wrapped by every error caused by a bad policy
+var ErrInvalid = errors.New("invalid policy")
+
+// Action ...an operation on trades that a policy grants
+type Action string
+
+const (
+	// Read lists trades and gets single trades, now or as of a past time
+	Read Action = "read"
+	// History gets the versions of a trade
+	History Action = "history"
+	// Create posts new trades, which are always the poster's own
+	Create Action = "create"
+	// Update replaces or patches a trade
+	Update Action = "update"
+	// Delete deletes a trade
+	Delete Action = "delete"
+)
+
+// Actions ...every Action, in the order they are listed
+var Actions = []Action{Read, History, Create, Update, Delete}
+
+// Scope ...the trades an Action is granted on
+type Scope int
+
+const (
+	// None grants the action on no trade
+	None Scope = iota
+	// Own grants the action on the trades the key's client posted
+	Own
+	// Any grants the action on every trade of the book
+	Any
+)
+
+func (s Scope) String() string {
+	switch s {
+	case Own:
+		return "own"
+	case Any:
+		return "any"
+	}
+	return "none"
+}
+
+// grants ...the scope of each granted action
+type grants map[Action]Scope
+
+// Policy ...the grants of every role. It is immutable once parsed, so it is
+// safe for concurrent use.
+type Policy struct {
+	defaults grants
+	roles    map[string]grants
+}
+
+// Default returns the policy used when none is configured: no roles, and
+// every action but Delete granted on the key's own trades, since deleting
+// needs a role that grants it
+func Default() *Policy {
+	g := grants{}
+	for _, a := range Actions {
+		if a != Delete {
+			g[a] = Own
+		}
+	}
+	return &Policy{defaults: g, roles: map[string]grants{}}
+}
+
+// document ...a policy as written in a file
+type document struct {
+	Default []string            `yaml:"default" toml:"default"`
+	Roles   map[string][]string `yaml:"roles" toml:"roles"`
+}
+
+// Load reads a YAML (.yaml, .yml) or TOML (.toml) policy file
+func Load(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := document{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &doc)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), &doc)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown key %s", undecoded[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("%w: policy file %s is not .yaml, .yml or .toml", ErrInvalid, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalid, path, err.Error())
+	}
+	p, err := parse(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalid, path, err.Error())
+	}
+	return p, nil
+}
+
+func parse(doc document) (*Policy, error) {
+	p := &Policy{roles: map[string]grants{}}
+	var err error
+	if p.defaults, err = parseGrants(doc.Default); err != nil {
+		return nil, fmt.Errorf("default: %s", err.Error())
+	}
+	for role, list := range doc.Roles {
+		if len(strings.TrimSpace(role)) == 0 {
+			return nil, errors.New("roles must be named")
+		}
+		if p.roles[role], err = parseGrants(list); err != nil {
+			return nil, fmt.Errorf("role %s: %s", role, err.Error())
+		}
+	}
+	return p, nil
+}
+
+// parseGrants parses a list of action or action:scope grants
+func parseGrants(list []string) (grants, error) {
+	g := grants{}
+	for _, item := range list {
+		name, scope, scoped := strings.Cut(strings.TrimSpace(item), ":")
+		a := Action(name)
+		if !a.valid() {
+			return nil, fmt.Errorf("unknown action %q", name)
+		}
+		s := Any
+		if scoped {
+			switch scope {
+			case "own":
+				s = Own
+			case "any":
+			default:
+				return nil, fmt.Errorf("scope of %s must be own or any", name)
+			}
+		}
+		if s > g[a] {
+			g[a] = s
+		}
+	}
+	return g, nil
+}
+
+func (a Action) valid() bool {
+	for _, known := range Actions {
+		if a == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope returns the widest scope in which any of roles is granted a, or the
+// scope of the default grants if roles is empty. Unknown roles grant nothing.
+func (p *Policy) Scope(roles []string, a Action) Scope {
+	if len(roles) == 0 {
+		return p.defaults[a]
+	}
+	s := None
+	for _, role := range roles {
+		if g := p.roles[role][a]; g > s {
+			s = g
+		}
+	}
+	return s
+}
+
+// HasRole reports whether the policy defines role
+func (p *Policy) HasRole(role string) bool {
+	_, ok := p.roles[role]
+	return ok
+}
+
+// Roles returns the names of the roles the policy defines, sorted
+func (p *Policy) Roles() []string {
+	roles := make([]string, 0, len(p.roles))
+	for role := range p.roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePolicy(t *testing.T, name, body string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(body), 0644))
+	return path
+}
+
+func TestDefault(t *testing.T) {
+	p := Default()
+	for _, a := range []Action{Read, History, Create, Update} {
+		assert.Equal(t, Own, p.Scope(nil, a), string(a))
+	}
+	assert.Equal(t, None, p.Scope(nil, Delete), "Deleting needs a role")
+	assert.False(t, p.HasRole("trader"))
+	assert.Equal(t, []string{}, p.Roles())
+}
+
+func TestLoad(t *testing.T) {
+	yamlPath := writePolicy(t, "policy.yaml", `
+default: [read:own]
+roles:
+  trader: [read:own, history:own, create, update:own]
+  compliance: [read:any, history]
+  supervisor: [read, delete:any]
+`)
+	tomlPath := writePolicy(t, "policy.toml", `
+default = ["read:own"]
+
+[roles]
+trader = ["read:own", "history:own", "create", "update:own"]
+compliance = ["read:any", "history"]
+supervisor = ["read", "delete:any"]
+`)
+	for _, path := range []string{yamlPath, tomlPath} {
+		p, err := Load(path)
+		assert.Nil(t, err, path)
+		assert.Equal(t, []string{"compliance", "supervisor", "trader"}, p.Roles())
+		assert.Equal(t, Own, p.Scope(nil, Read), "Keys without roles get the defaults")
+		assert.Equal(t, None, p.Scope(nil, Create))
+		assert.Equal(t, Any, p.Scope([]string{"trader"}, Create), "Actions without a scope are granted on any trade")
+		assert.Equal(t, Own, p.Scope([]string{"trader"}, Update))
+		assert.Equal(t, None, p.Scope([]string{"trader"}, Delete))
+		assert.Equal(t, Any, p.Scope([]string{"compliance"}, History))
+		assert.Equal(t, None, p.Scope([]string{"compliance"}, Update))
+		assert.Equal(t, Any, p.Scope([]string{"trader", "compliance"}, Read), "The widest scope of the roles wins")
+		assert.Equal(t, Any, p.Scope([]string{"trader", "supervisor"}, Delete))
+		assert.Equal(t, None, p.Scope([]string{"auditor"}, Read), "Unknown roles grant nothing")
+	}
+}
+
+func TestLoadRejectsBadPolicies(t *testing.T) {
+	for name, path := range map[string]string{
+		"missing file":   filepath.Join(t.TempDir(), "policy.yaml"),
+		"extension":      writePolicy(t, "policy.json", `{}`),
+		"yaml syntax":    writePolicy(t, "policy.yaml", `roles: [`),
+		"unknown key":    writePolicy(t, "policy.yaml", `rules: {}`),
+		"unknown toml":   writePolicy(t, "policy.toml", `rules = 1`),
+		"unknown action": writePolicy(t, "policy.yaml", `roles: {trader: [trade]}`),
+		"unknown scope":  writePolicy(t, "policy.yaml", `roles: {trader: ["read:all"]}`),
+		"bad default":    writePolicy(t, "policy.toml", `default = ["erase"]`),
+		"unnamed role":   writePolicy(t, "policy.yaml", `roles: {" ": [read]}`),
+	} {
+		_, err := Load(path)
+		assert.NotNil(t, err, name)
+		if name != "missing file" {
+			assert.True(t, errors.Is(err, ErrInvalid), name)
+		}
+	}
+}
+
+func TestLoadShippedPolicy(t *testing.T) {
+	p, err := Load("../policy.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"compliance", "middle_office", "supervisor", "trader"}, p.Roles())
+	assert.Equal(t, None, p.Scope(nil, Read), "Keys need a role")
+	assert.Equal(t, Own, p.Scope([]string{"trader"}, Update))
+	assert.Equal(t, Any, p.Scope([]string{"middle_office"}, Update))
+	assert.Equal(t, Any, p.Scope([]string{"compliance"}, History))
+	for _, role := range []string{"trader", "middle_office", "compliance"} {
+		assert.Equal(t, None, p.Scope([]string{role}, Delete), role)
+	}
+	assert.Equal(t, Any, p.Scope([]string{"supervisor"}, Delete))
+}
@@ -0,0 +1,186 @@
+// Package router matches requests to handlers by method and path pattern.
+//
+// Patterns are slash-separated segments; a segment is either a literal or a
+// parameter written {name} or {name:regexp}. A parameter matches exactly one
+// non-empty path segment (which may contain %2F-escaped slashes), and if a
+// regexp is given the whole segment must match it. Handlers read parameters
+// with Param.
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type segment struct {
+	literal string
+	param   string
+	// pattern constrains a parameter; nil accepts any segment
+	pattern *regexp.Regexp
+}
+
+type route struct {
+	pattern  string
+	segments []segment
+	methods  map[string]bool
+	handler  http.Handler
+}
+
+// Router ...http.Handler dispatching to the routes registered with Handle.
+// Routes are tried in registration order, so register more specific
+// patterns first.
+//
+// Paths are matched without trailing slashes, so /v1/trades/ is /v1/trades.
+// A path that matches a route but not its methods gets a 405 with an Allow
+// header, or a 204 with the Allow header for OPTIONS. HEAD is served by the
+// GET handler. A path that matches no route goes to NotFound.
+type Router struct {
+	routes []route
+
+	// NotFound serves unmatched paths; defaults to http.NotFound
+	NotFound http.Handler
+	// MethodNotAllowed serves matched paths with an unregistered method; the
+	// Allow header is already set. Defaults to a bare 405.
+	MethodNotAllowed http.Handler
+}
+
+// New returns a Router with no routes
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers h for pattern and the given methods. It panics on a
+// malformed pattern, as the patterns are fixed at startup.
+func (rt *Router) Handle(pattern string, h http.HandlerFunc, methods ...string) {
+	r := route{pattern: pattern, methods: map[string]bool{}, handler: h}
+	for _, m := range methods {
+		r.methods[m] = true
+	}
+	for _, s := range split(pattern) {
+		if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+			r.segments = append(r.segments, segment{literal: s})
+			continue
+		}
+		name := s[1 : len(s)-1]
+		seg := segment{param: name}
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			seg.param = name[:i]
+			seg.pattern = regexp.MustCompile("^(?:" + name[i+1:] + ")$")
+		}
+		if len(seg.param) == 0 {
+			panic("router: unnamed parameter in " + pattern)
+		}
+		r.segments = append(r.segments, seg)
+	}
+	rt.routes = append(rt.routes, r)
+}
+
+// split returns the segments of a path, ignoring leading and trailing slashes
+func split(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// match returns the parameters of r if parts matches it
+func (r route) match(parts []string) (map[string]string, bool) {
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, seg := range r.segments {
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+		if len(seg.param) == 0 {
+			if part != seg.literal {
+				return nil, false
+			}
+			continue
+		}
+		if len(part) == 0 || (seg.pattern != nil && !seg.pattern.MatchString(part)) {
+			return nil, false
+		}
+		params[seg.param] = part
+	}
+	return params, true
+}
+
+type paramsKey struct{}
+
+// Param returns the value of the path parameter name, or "" if the route has none
+func Param(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// Pattern returns the pattern of the route that the path of r matches,
+// whatever its method, or "" if it matches none
+func (rt *Router) Pattern(r *http.Request) string {
+	parts := split(r.URL.EscapedPath())
+	for _, route := range rt.routes {
+		if _, ok := route.match(parts); ok {
+			return route.pattern
+		}
+	}
+	return ""
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Segments are split before unescaping so that an escaped slash stays
+	// inside its parameter
+	parts := split(r.URL.EscapedPath())
+	allowed := map[string]bool{}
+	for _, route := range rt.routes {
+		params, ok := route.match(parts)
+		if !ok {
+			continue
+		}
+		method := r.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+		if route.methods[method] {
+			route.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), paramsKey{}, params)))
+			return
+		}
+		for m := range route.methods {
+			allowed[m] = true
+		}
+	}
+
+	if len(allowed) == 0 {
+		if rt.NotFound != nil {
+			rt.NotFound.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if allowed[http.MethodGet] {
+		allowed[http.MethodHead] = true
+	}
+	allowed[http.MethodOptions] = true
+	methods := make([]string, 0, len(allowed))
+	for m := range allowed {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if rt.MethodNotAllowed != nil {
+		rt.MethodNotAllowed.ServeHTTP(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serve(rt *Router, method, path string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	rt.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRouterMatchesParams(t *testing.T) {
+	rt := New()
+	rt.Handle("/{version:v1|v2}/items/special", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("special " + Param(r, "version")))
+	}, http.MethodGet)
+	rt.Handle("/{version:v1|v2}/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Param(r, "version") + " " + Param(r, "id") + Param(r, "missing")))
+	}, http.MethodGet)
+
+	assert.Equal(t, "v2 abc", serve(rt, "GET", "/v2/items/abc").Body.String())
+	assert.Equal(t, "special v1", serve(rt, "GET", "/v1/items/special").Body.String(), "Routes are tried in registration order")
+	assert.Equal(t, "v1 a/b", serve(rt, "GET", "/v1/items/a%2Fb").Body.String(), "An escaped slash stays in its parameter")
+	assert.Equal(t, "v1 abc", serve(rt, "GET", "/v1/items/abc/").Body.String(), "Trailing slashes are ignored")
+	assert.Equal(t, http.StatusNotFound, serve(rt, "GET", "/v1/items/a/b").Code)
+	assert.Equal(t, http.StatusNotFound, serve(rt, "GET", "/v3/items/abc").Code, "Parameters must match their pattern")
+	assert.Equal(t, http.StatusNotFound, serve(rt, "GET", "/v1/items").Code)
+
+	req, _ := http.NewRequest("DELETE", "/v2/items/abc/", nil)
+	assert.Equal(t, "/{version:v1|v2}/items/{id}", rt.Pattern(req), "Pattern ignores the method")
+	req, _ = http.NewRequest("GET", "/v1/other", nil)
+	assert.Equal(t, "", rt.Pattern(req))
+}
+
+func TestRouterMethods(t *testing.T) {
+	rt := New()
+	rt.Handle("/items", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	}, http.MethodGet, http.MethodPost)
+	rt.Handle("/{collection}", func(w http.ResponseWriter, r *http.Request) {}, http.MethodDelete)
+
+	assert.Equal(t, "POST", serve(rt, "POST", "/items").Body.String())
+	assert.Equal(t, http.StatusOK, serve(rt, "HEAD", "/items").Code, "HEAD is served by GET")
+
+	rr := serve(rt, "PUT", "/items")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS, POST", rr.Header().Get("Allow"))
+
+	rr = serve(rt, "DELETE", "/items")
+	assert.Equal(t, http.StatusOK, rr.Code, "Later routes are tried when the method does not match")
+
+	rr = serve(rt, "OPTIONS", "/items")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS, POST", rr.Header().Get("Allow"))
+
+	rt.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	rt.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	rr = serve(rt, "PATCH", "/things")
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	assert.Equal(t, "DELETE, OPTIONS", rr.Header().Get("Allow"))
+	assert.Equal(t, http.StatusGone, serve(rt, "GET", "/a/b").Code)
+}